@@ -0,0 +1,74 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package cmd
+
+import (
+	"batheart/daemon"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// checkConfig validates a config file the way the daemon would load it,
+// without touching sysfs, and exits non-zero on any problem.
+func checkConfig(args []string) {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	_ = flags.Parse(args)
+
+	path := flags.Arg(0)
+	if path == "" {
+		_, fullPath, err := configPaths()
+		if err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+		path = fullPath
+	}
+
+	cfg, err := daemon.LoadConfig(path, func(err error) error { return err })
+	if err != nil {
+		fmt.Printf("%s: %v\n", path, err)
+		os.Exit(1)
+	}
+
+	problems := checkPaths(cfg)
+	for _, problem := range problems {
+		fmt.Printf("%s: %s\n", path, problem)
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+	fmt.Printf("%s: ok, threshold %d%%\n", path, cfg.StopAt())
+}
+
+// checkPaths finds files the daemon would fail to create and configured
+// conservation controls that aren't there. Discovered ones and write
+// access are left to status and the daemon itself.
+func checkPaths(cfg *daemon.Config) []string {
+	var problems []string
+	if !cfg.MonitorOnly && (cfg.ConservePath != "" || len(cfg.ConservePaths) > 0) {
+		// conserve_paths are alternatives, one of them existing is enough
+		if path, err := daemon.ResolveConservePath(cfg); err != nil {
+			problems = append(problems, err.Error())
+		} else if _, err := os.Stat(path); err != nil {
+			problems = append(problems, fmt.Sprintf("conserve_path %s: %v", path, err))
+		}
+	}
+	for _, f := range []struct{ key, path string }{
+		{"log_file", cfg.LogFile},
+		{"pid_file", cfg.PidFile},
+	} {
+		if f.path == "" {
+			continue
+		}
+		if info, err := os.Stat(filepath.Dir(f.path)); err != nil {
+			problems = append(problems, fmt.Sprintf("%s %s: %v", f.key, f.path, err))
+		} else if !info.IsDir() {
+			problems = append(problems, fmt.Sprintf("%s %s: %s isn't a directory", f.key, f.path, filepath.Dir(f.path)))
+		}
+	}
+	return problems
+}
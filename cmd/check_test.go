@@ -0,0 +1,39 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package cmd
+
+import (
+	"batheart/daemon"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckPathsConserveControls(t *testing.T) {
+	dir := t.TempDir()
+	node := filepath.Join(dir, "conservation_mode")
+	if err := os.WriteFile(node, []byte("0\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing")
+
+	for _, tc := range []struct {
+		name  string
+		path  string
+		paths []string
+		ok    bool
+	}{
+		{"conserve_path", node, nil, true},
+		{"missing conserve_path", missing, nil, false},
+		{"one of conserve_paths", "", []string{missing, node}, true},
+		{"none of conserve_paths", "", []string{missing}, false},
+	} {
+		cfg := daemon.DefaultConfig()
+		cfg.ConservePath, cfg.ConservePaths = tc.path, tc.paths
+		if problems := checkPaths(&cfg); (len(problems) == 0) != tc.ok {
+			t.Errorf("%s: problems %q, want ok %t", tc.name, problems, tc.ok)
+		}
+	}
+}
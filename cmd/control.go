@@ -0,0 +1,25 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package cmd
+
+import (
+	"batheart/daemon"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// runControlCommand is the CLI for toggle, enable, disable, auto,
+// charge-full and storage.
+func runControlCommand(cmd string) {
+	reply, err := daemon.SendControl(cmd)
+	if err != nil {
+		fatal("Control command failed", "cmd", cmd, "err", err)
+	}
+	fmt.Println(reply)
+	if strings.HasPrefix(reply, "error") {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,142 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package cmd
+
+import (
+	"batheart/daemon"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// doctorCheck is one line of the doctor report, run returns the detail
+// printed when it passes.
+type doctorCheck struct {
+	name string
+	run  func() (string, error)
+}
+
+// doctor runs through everything the daemon needs, from the config to
+// writing the conservation control, and prints what passed. It exits
+// non-zero when anything failed.
+func doctor(args []string) {
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	writeTest := flags.Bool("write-test", false, "flip conservation mode and restore it, to see writes actually stick")
+	_ = flags.Parse(args)
+
+	defaults := daemon.DefaultConfig()
+	cfg := &defaults
+	b := daemon.NewBattery("")
+	var conservePath string
+	checks := []doctorCheck{
+		{"config", func() (string, error) {
+			_, fullPath, err := configPaths()
+			if err != nil {
+				return "", err
+			}
+			parsed, err := daemon.LoadConfig(fullPath, ignoreMissing)
+			if err != nil {
+				return "", fmt.Errorf("%s: %w, checking with the defaults", fullPath, err)
+			}
+			cfg = parsed
+			b = daemon.NewBattery(cfg.PinnedBattery())
+			if problems := checkPaths(cfg); len(problems) > 0 {
+				return "", fmt.Errorf("%s: %v", fullPath, problems)
+			}
+			if _, err := os.Stat(fullPath); errors.Is(err, os.ErrNotExist) {
+				return fullPath + " doesn't exist, using the defaults", nil
+			}
+			return fullPath, nil
+		}},
+		{"battery", func() (string, error) {
+			if err := daemon.CheckPowerSupply(); err != nil {
+				return "", err
+			}
+			if pinned := cfg.PinnedBattery(); pinned != "" {
+				if err := daemon.CheckBattery(pinned); err != nil {
+					return "", err
+				}
+			}
+			if err := b.Resolve(); err != nil {
+				return "", err
+			}
+			return b.Path(), nil
+		}},
+		{"capacity", func() (string, error) {
+			capacity, err := b.Capacity()
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%d%%", capacity), nil
+		}},
+		{"charging", func() (string, error) {
+			charging, err := b.Charging()
+			if err != nil {
+				return "", err
+			}
+			return strconv.FormatBool(charging), nil
+		}},
+		{"conserve path", func() (string, error) {
+			path, err := daemon.ResolveConservePath(cfg)
+			if err != nil {
+				return "", err
+			}
+			conservePath = path
+			return fmt.Sprintf("%s (%s)", path, daemon.ConserveKindOf(path)), nil
+		}},
+		{"conserve readable", func() (string, error) {
+			if conservePath == "" {
+				return "", errors.New("no conservation control")
+			}
+			enabled, err := daemon.ConservationEnabled(conservePath, cfg)
+			if err != nil {
+				return "", err
+			}
+			return "enabled " + strconv.FormatBool(enabled), nil
+		}},
+		{"conserve writable", func() (string, error) {
+			if conservePath == "" {
+				return "", errors.New("no conservation control")
+			}
+			if err := daemon.PreflightConservePath(conservePath); err != nil {
+				return "", fmt.Errorf("%w, run as root or see install-rules", err)
+			}
+			return "ok", nil
+		}},
+	}
+	if *writeTest {
+		checks = append(checks, doctorCheck{"write test", func() (string, error) {
+			if conservePath == "" {
+				return "", errors.New("no conservation control")
+			}
+			if _, err := daemon.SendControl("status"); err == nil {
+				fmt.Println("note: the daemon is running and may re-apply conservation during the test")
+			}
+			enabled, err := daemon.VerifyConservationWrite(conservePath, cfg)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("set enabled %t and restored %t", !enabled, enabled), nil
+		}})
+	}
+
+	failed := 0
+	for _, check := range checks {
+		detail, err := check.run()
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL %-18s %v\n", check.name+":", err)
+			continue
+		}
+		fmt.Printf("ok   %-18s %s\n", check.name+":", detail)
+	}
+	if failed > 0 {
+		fmt.Printf("%d of %d checks failed\n", failed, len(checks))
+		os.Exit(1)
+	}
+	fmt.Println("all checks passed")
+}
@@ -0,0 +1,78 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package cmd
+
+import (
+	"batheart/daemon"
+	"flag"
+	"fmt"
+	"github.com/knadh/koanf/parsers/toml"
+	"github.com/knadh/koanf/providers/structs"
+	"github.com/knadh/koanf/v2"
+	"os"
+	"time"
+)
+
+// dumpConfig prints the config as it's in effect after defaults, the file
+// and BATHEART_ variables are layered, defaulted keys included.
+func dumpConfig(args []string) {
+	flags := flag.NewFlagSet("config", flag.ExitOnError)
+	_ = flags.Parse(args)
+
+	cfg, err := effectiveConfig()
+	if err != nil {
+		fatal("Can't load config", "err", err)
+	}
+
+	merged := koanf.New(".")
+	if err := merged.Load(structs.Provider(cfg, "koanf"), nil); err != nil {
+		fatal("Can't collect config", "err", err)
+	}
+	out := readableConfig(merged.Raw())
+	if len(cfg.Profiles) > 0 {
+		var profiles []map[string]any
+		for _, p := range cfg.Profiles {
+			profiles = append(profiles, map[string]any{"name": p.Name, "start": p.Start, "end": p.End, "threshold": p.Threshold})
+		}
+		out["profiles"] = profiles
+	}
+
+	data, err := toml.Parser().Marshal(out)
+	if err != nil {
+		fatal("Can't marshal config", "err", err)
+	}
+	_, _ = os.Stdout.Write(data)
+}
+
+// effectiveConfig is the config file layered over the defaults, or the
+// defaults alone when there's no file. Unlike loadConfigOrDefault a broken
+// file is an error, printing defaults for it would hide that.
+func effectiveConfig() (*daemon.Config, error) {
+	_, fullPath, err := configPaths()
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := daemon.LoadConfig(fullPath, ignoreMissing)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fullPath, err)
+	}
+	return cfg, nil
+}
+
+// readableConfig writes durations the way they're written in the file,
+// 500ms rather than 500000000.
+func readableConfig(m map[string]any) map[string]any {
+	for key, v := range m {
+		switch v := v.(type) {
+		case time.Duration:
+			m[key] = v.String()
+		case map[string]any:
+			m[key] = readableConfig(v)
+		case nil:
+			delete(m, key)
+		}
+	}
+	return m
+}
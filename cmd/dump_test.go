@@ -0,0 +1,32 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEffectiveConfig(t *testing.T) {
+	prev := configOverride
+	defer func() { configOverride = prev }()
+	dir := t.TempDir()
+
+	// no file is fine, that's the defaults
+	configOverride = filepath.Join(dir, "missing.toml")
+	if cfg, err := effectiveConfig(); err != nil || cfg.Threshold != 80 {
+		t.Errorf("effectiveConfig without a file = %v, want the defaults", err)
+	}
+
+	// the same file check refuses mustn't print as the defaults
+	configOverride = filepath.Join(dir, "config.toml")
+	if err := os.WriteFile(configOverride, []byte("threshold = 90\nstart_threshold = 95\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err := effectiveConfig(); err == nil {
+		t.Errorf("effectiveConfig with start_threshold above threshold = threshold %d, want an error", cfg.Threshold)
+	}
+}
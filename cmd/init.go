@@ -0,0 +1,114 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package cmd
+
+import (
+	"batheart/daemon"
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+var configTemplate = template.Must(template.New("config").Parse(`# batheart config, see batheart status for what got detected
+
+# stop charging at this percentage
+threshold = {{.Threshold}}
+
+# for hardware with charge_control_start/end_threshold, 0 means unused
+start_threshold = 0
+stop_threshold = 0
+
+# the conservation node to write, detected: {{.Detected}}
+# leave empty to auto-detect on every start
+conserve_path = ""
+
+# pin one battery like "BAT1", empty aggregates all of them
+battery = ""
+
+# desktop notification when conservation mode changes
+notify = {{.Notify}}
+
+# debug, info, warn or error
+log_level = "{{.LogLevel}}"
+`))
+
+type initAnswers struct {
+	Threshold uint
+	Notify    bool
+	LogLevel  string
+	Detected  string
+}
+
+// initConfig asks a few questions and writes a commented config.toml.
+func initConfig(args []string) {
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	force := flags.Bool("force", false, "overwrite an existing config")
+	_ = flags.Parse(args)
+
+	dirPath, fullPath, err := configPaths()
+	if err != nil {
+		logCfgIssue("obtain user config dir", err)
+	}
+	if ext := filepath.Ext(fullPath); ext != ".toml" {
+		fatal("init only writes TOML configs", "path", fullPath)
+	}
+	if _, err := os.Stat(fullPath); err == nil && !*force {
+		fatal("Config already exists, pass --force to overwrite it", "path", fullPath)
+	}
+
+	answers := initAnswers{Detected: "nothing"}
+	if path, err := daemon.DiscoverConservePath(); err == nil {
+		answers.Detected = path
+	}
+	if b := daemon.NewBattery(""); b.Resolve() == nil {
+		fmt.Println("Detected battery:", b.Path())
+	}
+	fmt.Println("Detected conservation control:", answers.Detected)
+
+	in := bufio.NewReader(os.Stdin)
+	defaults := daemon.DefaultConfig()
+	for {
+		threshold, err := strconv.ParseUint(ask(in, "Threshold", strconv.Itoa(int(defaults.Threshold))), 10, 8)
+		if err == nil && threshold >= 1 && threshold <= 100 {
+			answers.Threshold = uint(threshold)
+			break
+		}
+		fmt.Println("The threshold has to be a number from 1 to 100")
+	}
+	answers.Notify = strings.HasPrefix(strings.ToLower(ask(in, "Desktop notifications (y/n)", "n")), "y")
+	for {
+		answers.LogLevel = ask(in, "Log level", defaults.LogLevel)
+		if _, err := daemon.ParseLogLevel(answers.LogLevel); err == nil {
+			break
+		}
+		fmt.Println("The log level has to be debug, info, warn or error")
+	}
+
+	var b strings.Builder
+	if err := configTemplate.Execute(&b, answers); err != nil {
+		fatal("Can't render config", "err", err)
+	}
+	if err := createConfigDir(dirPath); err != nil {
+		fatal("Can't create config dir", "err", err)
+	}
+	if err := writeConfigFile(fullPath, []byte(b.String())); err != nil {
+		fatal("Can't write config", "err", err)
+	}
+	fmt.Println("Wrote", fullPath)
+}
+
+func ask(in *bufio.Reader, question, def string) string {
+	fmt.Printf("%s [%s]: ", question, def)
+	answer, _ := in.ReadString('\n')
+	if answer = strings.TrimSpace(answer); answer != "" {
+		return answer
+	}
+	return def
+}
@@ -0,0 +1,41 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package cmd
+
+import (
+	"batheart/daemon"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// acquireLock takes an advisory lock so two daemons don't fight over the
+// conservation node. The kernel drops it if we die, so no stale locks.
+func acquireLock() (release func(), err error) {
+	dir, err := daemon.RuntimeDir()
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "batheart.lock")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		_ = f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("another batheart instance is running, it holds %s", path)
+		}
+		return nil, fmt.Errorf("can't lock %s: %w", path, err)
+	}
+
+	return func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		_ = f.Close()
+	}, nil
+}
@@ -0,0 +1,47 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package cmd
+
+import (
+	"batheart/daemon"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestReopenDuringReload(t *testing.T) {
+	prev := slog.Default()
+	defer func() {
+		slog.SetDefault(prev)
+		logFileMu.Lock()
+		if logFile != nil {
+			_ = logFile.Close()
+			logFile = nil
+		}
+		logFileMu.Unlock()
+	}()
+	dir := t.TempDir()
+	cfgs := []daemon.Config{daemon.DefaultConfig(), daemon.DefaultConfig()}
+	cfgs[0].LogFile = filepath.Join(dir, "a.log")
+	cfgs[1].LogFile = filepath.Join(dir, "b.log")
+
+	// reloads switching log_file while SIGHUP reopens it, for -race
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			setupLogger(&cfgs[i%2])
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			reopenLogFile()
+		}
+	}()
+	wg.Wait()
+}
@@ -0,0 +1,123 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package cmd
+
+import (
+	"batheart/daemon"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+)
+
+// shared by every logger setupLogger builds, so reloads can change it
+var logLevel = new(slog.LevelVar)
+
+// verbosity counts -v flags, 1 is debug and 2 or more is trace, and wins
+// over log_level
+var verbosity countFlag
+
+// countFlag is a bool flag adding up how often it's given.
+type countFlag int
+
+func (c *countFlag) IsBoolFlag() bool { return true }
+
+func (c *countFlag) String() string {
+	if c == nil {
+		return "0"
+	}
+	return strconv.Itoa(int(*c))
+}
+
+func (c *countFlag) Set(s string) error {
+	on, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	if on {
+		*c++
+	}
+	return nil
+}
+
+// doubleFlag is -vv, since the flag package only sees it as one more name.
+type doubleFlag struct{ *countFlag }
+
+func (d doubleFlag) Set(s string) error {
+	if err := d.countFlag.Set(s); err != nil {
+		return err
+	}
+	return d.countFlag.Set(s)
+}
+
+func setupLogger(cfg *daemon.Config) {
+	level, _ := daemon.ParseLogLevel(cfg.LogLevel)
+	switch {
+	case verbosity >= 2:
+		level = daemon.LevelTrace
+	case verbosity == 1:
+		level = slog.LevelDebug
+	}
+	logLevel.Set(level)
+
+	out, err := logOutput(cfg)
+
+	opts := &slog.HandlerOptions{Level: logLevel, ReplaceAttr: traceLevelName}
+	var handler slog.Handler
+	if cfg.LogFormat == "json" {
+		handler = slog.NewJSONHandler(out, opts)
+	} else {
+		handler = slog.NewTextHandler(out, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+
+	if err != nil {
+		slog.Warn("Can't open log_file, logging to stderr", "path", cfg.LogFile, "err", err)
+	}
+}
+
+// traceLevelName prints daemon.LevelTrace as TRACE rather than DEBUG-4.
+func traceLevelName(groups []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.LevelKey && len(groups) == 0 {
+		if level, ok := a.Value.Any().(slog.Level); ok && level == daemon.LevelTrace {
+			a.Value = slog.StringValue("TRACE")
+		}
+	}
+	return a
+}
+
+// logOutput is log_file when it's set, reusing the open one across reloads,
+// and stderr otherwise.
+func logOutput(cfg *daemon.Config) (io.Writer, error) {
+	logFileMu.Lock()
+	defer logFileMu.Unlock()
+
+	maxSize := int64(cfg.LogMaxSizeMB) << 20
+	if logFile != nil && logFile.path == cfg.LogFile {
+		logFile.mu.Lock()
+		logFile.maxSize, logFile.maxBackups = maxSize, int(cfg.LogMaxBackups)
+		logFile.mu.Unlock()
+		return logFile, nil
+	}
+	if logFile != nil {
+		_ = logFile.Close()
+		logFile = nil
+	}
+	if cfg.LogFile == "" {
+		return os.Stderr, nil
+	}
+
+	f, err := openRotatingFile(cfg.LogFile, maxSize, int(cfg.LogMaxBackups))
+	if err != nil {
+		return os.Stderr, err
+	}
+	logFile = f
+	return logFile, nil
+}
+
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -24,212 +24,273 @@ THE SOFTWARE.
 package cmd
 
 import (
+	"batheart/daemon"
+	"context"
 	"errors"
+	"flag"
 	"fmt"
-	"gioui.org/x/pref/battery"
-	"github.com/knadh/koanf/parsers/toml"
-	"github.com/knadh/koanf/providers/file"
 	"github.com/knadh/koanf/providers/structs"
 	"github.com/knadh/koanf/v2"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"syscall"
-	"time"
 )
 
-const (
-	batteryCapacityPath = "/sys/class/power_supply/BAT0/capacity"
-	conserveSetPath     = "/sys/bus/platform/drivers/ideapad_acpi/VPC2004:00/conservation_mode"
-)
+// where root's config lives when there's no HOME to find it by
+const systemConfigDir = "/etc/batheart"
 
 var (
-	k      = koanf.New(".")
-	parser = toml.Parser()
+	// set by --dry-run, wins over dry_run in config
+	forceDryRun bool
+	// set by --config or BATHEART_CONFIG, see configPaths
+	configOverride string
 )
 
-type config struct {
-	Threshold uint `koanf:"threshold"`
-}
+func Execute() {
+	flags := flag.NewFlagSet("batheart", flag.ExitOnError)
+	flags.BoolVar(&forceDryRun, "dry-run", false, "log conservation changes without writing to sysfs")
+	once := flags.Bool("once", false, "evaluate the battery once and exit, for cron or timers")
+	flags.StringVar(&configOverride, "config", os.Getenv("BATHEART_CONFIG"), "config file to use instead of the XDG one")
+	flags.Var(&verbosity, "v", "log more than log_level, -v for debug and -vv for trace")
+	flags.Var(&verbosity, "verbose", "same as -v")
+	flags.Var(doubleFlag{&verbosity}, "vv", "same as -v -v")
+	_ = flags.Parse(os.Args[1:])
+
+	if flags.NArg() > 0 {
+		switch flags.Arg(0) {
+		case "status":
+			Status(flags.Args()[1:])
+			return
+		case "watch":
+			watch()
+			return
+		case "check":
+			checkConfig(flags.Args()[1:])
+			return
+		case "doctor":
+			doctor(flags.Args()[1:])
+			return
+		case "uninstall":
+			uninstall(flags.Args()[1:])
+			return
+		case "config":
+			dumpConfig(flags.Args()[1:])
+			return
+		case "init":
+			initConfig(flags.Args()[1:])
+			return
+		case "install-rules":
+			installRules(flags.Args()[1:])
+			return
+		case "version":
+			printVersion()
+			return
+		case "toggle", "enable", "disable", "auto", "charge-full":
+			runControlCommand(flags.Arg(0))
+			return
+		case "storage":
+			runControlCommand(strings.Join(flags.Args(), " "))
+			return
+		default:
+			fatal("Unknown command", "command", flags.Arg(0))
+		}
+	}
 
-// not sure if this or battery.Level() is better
-func getBatteryCapacity() (int, error) {
-	content, err := os.ReadFile(batteryCapacityPath)
+	release, err := acquireLock()
 	if err != nil {
-		return 0, err
+		fatal("Can't start", "err", err)
 	}
-	capacityStr := strings.TrimSpace(string(content))
-	return strconv.Atoi(capacityStr)
-}
+	defer release()
 
-func setConservationMode(b bool) {
-	var enabled []byte
-	if b {
-		enabled = []byte("1")
-	} else {
-		enabled = []byte("0")
+	// i don't care how shit this code is actually
+	dirPath, fullPath, err := configPaths()
+	if err != nil {
+		logCfgIssue("obtain user config dir", err)
 	}
 
-	if err := os.WriteFile(conserveSetPath, enabled, 0644); err != nil {
-		log.Printf("can't change conservation mode: %v", err)
-	} else {
-		log.Println("Changed conservation mode to:", string(enabled))
+	cfg, err := daemon.LoadConfig(fullPath, handleConfigError(dirPath, fullPath))
+	if errors.Is(err, errConfigWrite) || errors.Is(err, errConfigUnreadable) {
+		slog.Warn("Using default config", "err", err)
+		cfg, err = daemon.LoadConfig(fullPath, func(error) error { return nil })
+	}
+	if err != nil {
+		logCfgIssue("load "+fullPath, err)
 	}
-}
-
-func runDaemon(provider *file.File, cfg *config) {
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
 
-	if err := provider.Watch(
-		func(event interface{}, err error) {
-			if err != nil {
-				log.Printf("Error in config Watch: %v", err)
-				return
-			}
+	setupLogger(cfg)
 
-			log.Println("Config changed, reloading!")
+	if cfg.PidFile != "" && !*once {
+		remove, err := writePidFile(cfg.PidFile)
+		if err != nil {
+			fatal("Can't write PID file", "err", err)
+		}
+		defer remove()
+	}
 
-			k = koanf.New(".")
-			cfg = parseConfig(provider, func(err error) bool { return true })
-		},
-	); err != nil {
-		log.Printf("Config watch error: %v", err)
+	if err := daemon.CheckPowerSupply(); err != nil {
+		fatal("This system has no battery sysfs, batheart can't run here", "err", err)
+	}
+	if cfg.PrimaryBattery != "" {
+		if err := daemon.CheckBattery(cfg.PrimaryBattery); err != nil {
+			fatal("Can't use primary_battery", "err", err)
+		}
+	}
+	b := daemon.NewBattery(cfg.PinnedBattery())
+	if _, err := b.Capacity(); err != nil {
+		fatal("Can't read battery capacity", "err", err)
+	}
+	slog.Info("Using battery", "path", b.Path(), "pinned", cfg.PinnedBattery() != "", "batteries", len(b.Paths()))
+	id := b.Identity()
+	slog.Info("Battery identity", "manufacturer", id.Manufacturer, "model", id.Model, "serial", id.Serial, "technology", id.Technology)
+
+	d := daemon.New(*cfg, nil)
+	d.DryRun = forceDryRun
+	if *once {
+		if err := d.Once(); err != nil {
+			fatal("Can't apply conservation mode", "err", err)
+		}
 		return
 	}
-
-	ticker := time.NewTicker(time.Minute)
-	defer ticker.Stop()
-	defer log.Println("Batheart has been shut down")
-
-	prevLevel := uint(0)
-
-	log.Println("Batheart have been enabled")
-	for {
-		select {
-		case <-sigChan:
-			return
-		case <-ticker.C:
-			l, err := battery.Level()
-			if err != nil {
-				log.Printf("Error reading battery level: %v", err)
-				continue
-			}
-			level := uint(l)
-			if level == prevLevel {
-				continue
-			}
-
-			inThreshold := level >= cfg.Threshold
-			isCharging := level > prevLevel
-
-			setConservationMode(inThreshold)
-
-			if level >= cfg.Threshold-1 && isCharging {
-				ticker.Reset(time.Second * 10)
-			} else if !inThreshold && level < cfg.Threshold-5 { // Add hysteresis
-				ticker.Reset(time.Minute * 10)
-			} else {
-				ticker.Reset(time.Minute * 5)
-			}
-
-			prevLevel = level
+	d.ConfigPath = fullPath
+	d.OnReload = setupLogger
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for range hup {
+			slog.Info("Received SIGHUP, reloading config!")
+			reopenLogFile()
+			d.Reload()
 		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if err := d.Run(ctx); err != nil {
+		fatal("Batheart stopped", "err", err)
 	}
 }
 
-func Execute() {
-	// i don't care how shit this code is actually
-	configHome, err := os.UserConfigDir()
-	if err != nil {
-		logCfgIssue("obtain user config dir", err)
+func configPaths() (dirPath, fullPath string, err error) {
+	if configOverride != "" {
+		return filepath.Dir(configOverride), configOverride, nil
 	}
 
-	dirPath := filepath.Join(configHome, "batheart")
-	fullPath := filepath.Join(dirPath, "config.toml")
-	provider := file.Provider(fullPath)
-
-	cfg := parseConfig(provider, handleConfigError(dirPath, fullPath))
-	if cfg == nil {
-		fmt.Println("Using default config")
+	configHome, err := os.UserConfigDir()
+	switch {
+	case err == nil:
+		dirPath = filepath.Join(configHome, "batheart")
+	case os.Geteuid() == 0:
+		// system services often run without HOME or XDG_CONFIG_HOME
+		dirPath = systemConfigDir
+	default:
+		return "", "", fmt.Errorf("%w, set XDG_CONFIG_HOME or HOME, or pass --config", err)
 	}
-
-	runDaemon(provider, cfg)
+	return dirPath, filepath.Join(dirPath, "config.toml"), nil
 }
 
-func parseConfig(
-	provider *file.File,
-	errHandler func(err error) bool,
-) *config {
-	if !errHandler(k.Load(provider, parser)) {
-		return nil
+// loadConfigOrDefault reads the config for the read-only commands, which
+// shouldn't create one when it's missing.
+func loadConfigOrDefault() *daemon.Config {
+	if _, fullPath, err := configPaths(); err == nil {
+		if cfg, err := daemon.LoadConfig(fullPath, ignoreMissing); err == nil {
+			return cfg
+		}
 	}
+	cfg := daemon.DefaultConfig()
+	return &cfg
+}
 
-	var cfg config
-
-	if err := k.Unmarshal("", &cfg); err != nil {
-		logCfgIssue("parse", err)
+func ignoreMissing(err error) error {
+	if errors.Is(err, os.ErrNotExist) {
 		return nil
 	}
-
-	return &cfg
+	return err
 }
 
-func handleConfigError(dirPath, fullPath string) func(err error) bool {
-	return func(err error) bool {
+// errConfigWrite marks failures to save the default config, the defaults
+// themselves are still usable from memory.
+var errConfigWrite = errors.New("can't write default config")
+
+// errConfigUnreadable means the file is there but we may not read it.
+var errConfigUnreadable = errors.New("config file isn't readable")
+
+func handleConfigError(dirPath, fullPath string) func(err error) error {
+	return func(err error) error {
 		if err != nil {
-			if !errors.Is(err, os.ErrNotExist) {
-				logCfgIssue("load", err)
-				return false
+			if errors.Is(err, os.ErrPermission) {
+				return fmt.Errorf("%w: %s needs read permission for uid %d: %w", errConfigUnreadable, fullPath, os.Getuid(), err)
 			}
-			if !acquireConfig(dirPath, fullPath) {
-				return false
+			if !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("load: %w", err)
 			}
+			return acquireConfig(dirPath, fullPath)
 		}
-		return true
+		return nil
 	}
 }
 
-func acquireConfig(dirPath string, fullPath string) bool {
-	loadDefaultConfig()
-	return createConfigDir(dirPath) && createConfigFile(fullPath)
+func acquireConfig(dirPath string, fullPath string) error {
+	if err := createConfigDir(dirPath); err != nil {
+		return err
+	}
+	return createConfigFile(fullPath)
 }
 
-func createConfigDir(path string) bool {
-	if err := os.MkdirAll(path, os.ModePerm); err != nil {
-		logCfgIssue("create config file", err)
-		return false
+func createConfigDir(path string) error {
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return fmt.Errorf("%w: create config dir: %w", errConfigWrite, err)
 	}
-	return true
+	return nil
 }
 
-func createConfigFile(path string) bool {
-	data, err := k.Marshal(parser)
+func createConfigFile(path string) error {
+	k := koanf.New(".")
+	_ = k.Load(structs.Provider(daemon.DefaultConfig(), "koanf"), nil)
+	data, err := k.Marshal(daemon.ParserFor(path))
 	if err != nil {
-		logCfgIssue("marshal", err)
-		return false
+		return fmt.Errorf("%w: marshal: %w", errConfigWrite, err)
 	}
 
-	if err := os.WriteFile(path, data, os.ModePerm); err != nil {
-		logCfgIssue("write to config file", err)
-		return false
+	if err := writeConfigFile(path, data); err != nil {
+		return fmt.Errorf("%w: write to config file: %w", errConfigWrite, err)
 	}
 
-	return true
+	return nil
 }
 
-func loadDefaultConfig() {
-	c := &config{
-		Threshold: 80,
+// writeConfigFile goes through a temp file in the same directory and renames
+// it into place, so a crash or the watcher never sees a half-written config.
+func writeConfigFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
 	}
+	defer os.Remove(tmp.Name())
 
-	_ = k.Load(structs.Provider(c, "koanf"), nil)
-	return
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// the config decides what runs as the daemon's user (on_enable_cmd and
+	// friends) and where it writes, so nobody else gets to read or edit it
+	if err := os.Chmod(tmp.Name(), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
 }
 
 func logCfgIssue(action string, err error) {
-	log.Fatalf("Config issue, can't %s ----> %v", action, err)
+	fatal("Config issue, can't "+action, "err", err)
 }
@@ -0,0 +1,78 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package cmd
+
+import (
+	"batheart/daemon"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestUnreadableConfig(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root reads mode 0000 files regardless")
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.toml")
+	if err := os.WriteFile(path, []byte("threshold = 90\n"), 0o000); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := daemon.LoadConfig(path, handleConfigError(dir, path))
+	if !errors.Is(err, errConfigUnreadable) || !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("LoadConfig = %v, want errConfigUnreadable wrapping EACCES", err)
+	}
+}
+
+func TestHandleConfigErrorPermission(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.toml")
+	eacces := &fs.PathError{Op: "open", Path: path, Err: syscall.EACCES}
+
+	err := handleConfigError(dir, path)(eacces)
+	if !errors.Is(err, errConfigUnreadable) {
+		t.Errorf("handleConfigError(EACCES) = %v, want errConfigUnreadable", err)
+	}
+	// it must not have gone on to create a default config over it
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("config created on a permission error: %v", err)
+	}
+}
+
+func TestConfigPathsWithoutHome(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("HOME", "")
+	prev := configOverride
+	configOverride = ""
+	defer func() { configOverride = prev }()
+
+	dir, full, err := configPaths()
+	if os.Geteuid() != 0 {
+		if err == nil {
+			t.Errorf("configPaths = %s, want an error without HOME or --config", full)
+		}
+		return
+	}
+	if err != nil || dir != systemConfigDir || full != filepath.Join(systemConfigDir, "config.toml") {
+		t.Errorf("configPaths as root = %s, %s, %v, want %s", dir, full, err, systemConfigDir)
+	}
+}
+
+func TestConfigPathsOverride(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("HOME", "")
+	prev := configOverride
+	configOverride = "/srv/batheart/batheart.yaml"
+	defer func() { configOverride = prev }()
+
+	dir, full, err := configPaths()
+	if err != nil || dir != "/srv/batheart" || full != configOverride {
+		t.Errorf("configPaths with --config = %s, %s, %v", dir, full, err)
+	}
+}
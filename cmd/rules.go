@@ -0,0 +1,80 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package cmd
+
+import (
+	"batheart/daemon"
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const udevRulesPath = "/etc/udev/rules.d/99-batheart.rules"
+
+// installRules prints a udev rule letting a group write the detected
+// conservation nodes, or writes it to udevRulesPath with --write.
+func installRules(args []string) {
+	flags := flag.NewFlagSet("install-rules", flag.ExitOnError)
+	group := flags.String("group", "batheart", "group to grant write access to")
+	write := flags.Bool("write", false, "write the rule to "+udevRulesPath)
+	_ = flags.Parse(args)
+
+	cfg := loadConfigOrDefault()
+	path, err := daemon.ResolveConservePath(cfg)
+	if err != nil {
+		fatal("Can't find conservation mode control", "err", err)
+	}
+
+	rules, err := udevRules(*group, path, daemon.StartNodePath(path))
+	if err != nil {
+		fatal("Can't generate udev rules", "err", err)
+	}
+
+	if !*write {
+		fmt.Print(rules)
+		return
+	}
+	if !confirm(fmt.Sprintf("Write %s?", udevRulesPath)) {
+		return
+	}
+	if err := os.WriteFile(udevRulesPath, []byte(rules), 0644); err != nil {
+		fatal("Can't write udev rules", "err", err)
+	}
+	fmt.Println("Wrote", udevRulesPath)
+	fmt.Println("Run `udevadm control --reload && udevadm trigger` and add yourself to the", *group, "group")
+}
+
+func udevRules(group string, paths ...string) (string, error) {
+	var b strings.Builder
+	b.WriteString("# generated by batheart install-rules\n")
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		attr, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return "", err
+		}
+		dev := filepath.Dir(attr)
+		subsystem, err := filepath.EvalSymlinks(filepath.Join(dev, "subsystem"))
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Fprintf(&b, "ACTION==\"add\", SUBSYSTEM==\"%s\", KERNEL==\"%s\", RUN+=\"/bin/chgrp %s %s\", RUN+=\"/bin/chmod g+w %s\"\n",
+			filepath.Base(subsystem), filepath.Base(dev), group, attr, attr)
+	}
+	return b.String(), nil
+}
+
+func confirm(question string) bool {
+	fmt.Print(question, " [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
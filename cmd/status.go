@@ -0,0 +1,155 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package cmd
+
+import (
+	"batheart/daemon"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Status prints the battery and conservation state straight from sysfs, so
+// it works whether the daemon is running or not.
+func Status(args []string) {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print a JSON object for scripts and status bars")
+	_ = flags.Parse(args)
+
+	cfg := loadConfigOrDefault()
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		if err := enc.Encode(readStatusJSON(cfg)); err != nil {
+			fatal("Can't encode status", "err", err)
+		}
+		return
+	}
+	writeStatus(os.Stdout, cfg)
+}
+
+// statusJSON leaves out whatever couldn't be read instead of zeroing it.
+type statusJSON struct {
+	Battery             string   `json:"battery,omitempty"`
+	Capacity            *int     `json:"capacity,omitempty"`
+	Charging            *bool    `json:"charging,omitempty"`
+	Adapter             string   `json:"adapter,omitempty"`
+	ConservationEnabled *bool    `json:"conservation_enabled,omitempty"`
+	Health              *float64 `json:"health,omitempty"`
+	Temperature         *float64 `json:"temperature,omitempty"`
+	// in seconds, until full when charging and until empty otherwise
+	ETA *float64 `json:"eta,omitempty"`
+	daemon.Identity
+}
+
+func readStatusJSON(cfg *daemon.Config) statusJSON {
+	var st statusJSON
+	b := daemon.NewBattery(cfg.PinnedBattery())
+	level, err := b.Capacity()
+	if err != nil {
+		return st
+	}
+	capacity := int(level)
+	st.Battery, st.Capacity = b.Path(), &capacity
+	st.Identity = b.Identity()
+
+	if charging, err := b.Charging(); err == nil {
+		st.Charging = &charging
+	}
+	st.Adapter, _ = daemon.PluggedIn()
+	if health, err := b.Health(); err == nil {
+		st.Health = &health
+	}
+	if temp, err := b.Temperature(); err == nil {
+		st.Temperature = &temp
+	}
+	if eta, _, err := b.ETA(); err == nil {
+		seconds := eta.Round(time.Second).Seconds()
+		st.ETA = &seconds
+	}
+	if path, err := daemon.ResolveConservePath(cfg); err == nil {
+		if enabled, err := daemon.ConservationEnabled(path, cfg); err == nil {
+			st.ConservationEnabled = &enabled
+		}
+	}
+	return st
+}
+
+func writeStatus(w io.Writer, cfg *daemon.Config) {
+	b := daemon.NewBattery(cfg.PinnedBattery())
+	capacity, err := b.Capacity()
+	if err != nil {
+		fmt.Fprintln(w, "Battery:      ", describeErr(err))
+		return
+	}
+	fmt.Fprintln(w, "Battery:      ", b.Path())
+	id := b.Identity()
+	for _, field := range []struct{ label, value string }{
+		{"Manufacturer: ", id.Manufacturer},
+		{"Model:        ", id.Model},
+		{"Serial:       ", id.Serial},
+		{"Technology:   ", id.Technology},
+	} {
+		if field.value != "" {
+			fmt.Fprintln(w, field.label, field.value)
+		}
+	}
+	fmt.Fprintf(w, "Capacity:      %d%%\n", capacity)
+	fmt.Fprintln(w, "Status:       ", readOrUnknown(filepath.Join(b.Path(), "status")))
+	if charging, err := b.Charging(); err == nil {
+		fmt.Fprintln(w, "Charging:     ", charging)
+	}
+	if adapter, plugged := daemon.PluggedIn(); plugged {
+		fmt.Fprintln(w, "AC adapter:   ", adapter)
+	} else {
+		fmt.Fprintln(w, "AC adapter:    unplugged")
+	}
+	if health, err := b.Health(); err == nil {
+		fmt.Fprintf(w, "Health:        %.1f%%\n", health)
+	} else {
+		fmt.Fprintln(w, "Health:       ", describeErr(err))
+	}
+	if eta, charging, err := b.ETA(); err == nil {
+		until := "empty"
+		if charging {
+			until = "full"
+		}
+		fmt.Fprintf(w, "ETA:           %s until %s\n", eta.Round(time.Minute), until)
+	} else {
+		fmt.Fprintln(w, "ETA:          ", describeErr(err))
+	}
+	if temp, err := b.Temperature(); err == nil {
+		fmt.Fprintf(w, "Temperature:   %.1f°C\n", temp)
+	}
+
+	path, err := daemon.ResolveConservePath(cfg)
+	if err != nil {
+		fmt.Fprintln(w, "Conservation: ", describeErr(err))
+		return
+	}
+	fmt.Fprintln(w, "Conserve path:", path)
+	fmt.Fprintln(w, "Conservation: ", readOrUnknown(path))
+
+	if reply, err := daemon.SendControl("status"); err == nil {
+		fmt.Fprintln(w, "Daemon:       ", reply)
+	} else {
+		fmt.Fprintln(w, "Daemon:        not running")
+	}
+}
+
+func readOrUnknown(path string) string {
+	value, err := daemon.ReadSysfs(path)
+	if err != nil {
+		return describeErr(err)
+	}
+	return value
+}
+
+func describeErr(err error) string {
+	return fmt.Sprintf("unknown (%v)", err)
+}
@@ -0,0 +1,87 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package cmd
+
+import (
+	"batheart/daemon"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// uninstall puts the machine back the way it was: conservation off, and
+// the udev rule, runtime files and config removed, asking before each step.
+func uninstall(args []string) {
+	flags := flag.NewFlagSet("uninstall", flag.ExitOnError)
+	yes := flags.Bool("yes", false, "don't ask before each step")
+	_ = flags.Parse(args)
+
+	if _, err := daemon.SendControl("status"); err == nil {
+		fatal("The daemon is running, stop it first or it sets conservation mode again")
+	}
+
+	ask := func(question string) bool {
+		return *yes || confirm(question)
+	}
+
+	cfg := loadConfigOrDefault()
+	cfg.DryRun = cfg.DryRun || forceDryRun
+	if path, err := daemon.ResolveConservePath(cfg); err != nil {
+		fmt.Println("Skipped conservation mode:", err)
+	} else if ask(fmt.Sprintf("Disable conservation mode (%s)?", path)) {
+		if err := daemon.SetConservation(path, false, 100, cfg); err != nil {
+			fmt.Println("Can't disable conservation mode:", err)
+		} else if cfg.DryRun {
+			fmt.Println("Dry run, conservation mode wasn't written")
+		} else {
+			fmt.Println("Disabled conservation mode")
+		}
+	}
+
+	candidates := []string{udevRulesPath, cfg.PidFile}
+	if dir, err := daemon.RuntimeDir(); err == nil {
+		candidates = append(candidates, filepath.Join(dir, "batheart.sock"), filepath.Join(dir, "batheart.lock"))
+	}
+	var files []string
+	for _, path := range candidates {
+		if _, err := os.Stat(path); path != "" && err == nil {
+			files = append(files, path)
+		}
+	}
+	for _, path := range files {
+		if !ask(fmt.Sprintf("Remove %s?", path)) {
+			continue
+		}
+		if removeReporting(path, os.Remove) && path == udevRulesPath {
+			fmt.Println("Run `udevadm control --reload` for it to take effect")
+		}
+	}
+
+	dirPath, fullPath, err := configPaths()
+	switch {
+	case err != nil:
+		fmt.Println("Skipped config:", err)
+	case configOverride != "":
+		// --config may point anywhere, only take the file itself
+		if ask(fmt.Sprintf("Remove %s?", fullPath)) {
+			removeReporting(fullPath, os.Remove)
+		}
+	default:
+		if _, err := os.Stat(dirPath); err == nil && ask(fmt.Sprintf("Remove %s and everything in it?", dirPath)) {
+			removeReporting(dirPath, os.RemoveAll)
+		}
+	}
+}
+
+func removeReporting(path string, remove func(string) error) bool {
+	if err := remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Println("Can't remove", path+":", err)
+		return false
+	}
+	fmt.Println("Removed", path)
+	return true
+}
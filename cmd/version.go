@@ -0,0 +1,57 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// set at build time, e.g.
+// go build -ldflags "-X batheart/cmd.version=v1.2.0 -X batheart/cmd.commit=$(git rev-parse HEAD) -X batheart/cmd.date=$(date -u +%FT%TZ)"
+var (
+	version string
+	commit  string
+	date    string
+)
+
+// buildInfo fills whatever -ldflags left empty from the info Go embeds
+// into module builds.
+func buildInfo() (v, c, d string) {
+	v, c, d = version, commit, date
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v == "" {
+			v = info.Main.Version
+		}
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && c == "":
+				c = s.Value
+			case s.Key == "vcs.time" && d == "":
+				d = s.Value
+			}
+		}
+	}
+	if v == "" {
+		v = "(devel)"
+	}
+	return v, unknownIfEmpty(c), unknownIfEmpty(d)
+}
+
+func unknownIfEmpty(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+func printVersion() {
+	v, c, d := buildInfo()
+	fmt.Println("batheart", v)
+	fmt.Println("commit:  ", c)
+	fmt.Println("built:   ", d)
+	fmt.Printf("go:       %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
@@ -0,0 +1,47 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// watch redraws the status every second until interrupted, read-only like
+// status and without needing the daemon.
+func watch() {
+	cfg := loadConfigOrDefault()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// hide the cursor while redrawing, and bring it back however we leave
+	fmt.Print("\033[?25l")
+	defer fmt.Print("\033[?25h")
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var buf bytes.Buffer
+	for {
+		buf.Reset()
+		buf.WriteString("\033[H\033[2J")
+		writeStatus(&buf, cfg)
+		fmt.Fprintf(&buf, "\n%s, Ctrl-C to quit\n", time.Now().Format(time.TimeOnly))
+		_, _ = os.Stdout.Write(buf.Bytes())
+
+		select {
+		case <-ctx.Done():
+			fmt.Println()
+			return
+		case <-ticker.C:
+		}
+	}
+}
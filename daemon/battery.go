@@ -0,0 +1,514 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gioui.org/x/pref/battery"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// every sysfs path hangs off this, so tests can point it at a fake tree
+var sysfsRoot = "/sys"
+
+func powerSupplyDir() string {
+	return filepath.Join(sysfsRoot, "class/power_supply")
+}
+
+// ErrNoPowerSupply is when there's no power_supply class in sysfs at all,
+// as in most containers and WSL.
+var ErrNoPowerSupply = errors.New("no power_supply class in sysfs")
+
+// CheckPowerSupply tells apart a system without battery sysfs from one
+// where reading the battery merely failed.
+func CheckPowerSupply() error {
+	if _, err := os.Stat(powerSupplyDir()); errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %s is missing", ErrNoPowerSupply, powerSupplyDir())
+	}
+	return nil
+}
+
+// BatterySource is what the daemon reads the battery state from.
+type BatterySource interface {
+	Capacity() (uint, error)
+	Charging() (bool, error)
+}
+
+// gioBattery reads the battery through gioui's pref package, switching
+// to sysfs for good once it says the platform isn't supported.
+type gioBattery struct {
+	sysfs    *Battery
+	fallback BatterySource
+	// set by unavailable until switched reports it
+	justSwitched bool
+}
+
+func (g *gioBattery) Capacity() (uint, error) {
+	if g.fallback != nil {
+		return g.fallback.Capacity()
+	}
+	l, err := battery.Level()
+	if g.unavailable(err) {
+		return g.fallback.Capacity()
+	}
+	return uint(l), err
+}
+
+func (g *gioBattery) Charging() (bool, error) {
+	if g.fallback != nil {
+		return g.fallback.Charging()
+	}
+	charging, err := battery.IsCharging()
+	if g.unavailable(err) {
+		return g.fallback.Charging()
+	}
+	return charging, err
+}
+
+// unavailable tells whether err means gio will never work here, rather
+// than a read that failed this once.
+func (g *gioBattery) unavailable(err error) bool {
+	if !errors.Is(err, battery.ErrNotAvailableAPI) {
+		return false
+	}
+	slog.Warn("The gio battery backend isn't available here, falling back to sysfs", "err", err)
+	g.fallback = g.sysfs
+	g.justSwitched = true
+	return true
+}
+
+// switched tells once whether reads went over to sysfs since it was last
+// asked, their levels don't average with gio's.
+func (g *gioBattery) switched() bool {
+	s := g.justSwitched
+	g.justSwitched = false
+	return s
+}
+
+// Battery reads the battery from /sys/class/power_supply directly,
+// aggregated over every battery unless one is pinned. The paths are
+// resolved on first use and again whenever they go away.
+type Battery struct {
+	// the battery config key, aggregate over all batteries when empty
+	pinned string
+	// resolved by Resolve, see withBatteries
+	path string
+	// all batteries to aggregate, just path when one is pinned
+	paths []string
+}
+
+// NewBattery reads the battery named pinned, like "BAT1", or all of them
+// when it's empty.
+func NewBattery(pinned string) *Battery {
+	return &Battery{pinned: pinned}
+}
+
+// Path is the battery picked by Resolve, the one identity, health and the
+// charge rate are read from.
+func (b *Battery) Path() string {
+	return b.path
+}
+
+// Paths are all the batteries capacity is aggregated over.
+func (b *Battery) Paths() []string {
+	return b.paths
+}
+
+func newBatterySource(backend string, sysfs *Battery) BatterySource {
+	switch backend {
+	case "gio":
+		return &gioBattery{sysfs: sysfs}
+	case "upower":
+		u, err := newUpowerBattery()
+		if err == nil {
+			return u
+		}
+		slog.Warn("Falling back to the sysfs battery backend", "err", err)
+	}
+	return sysfs
+}
+
+// batteryDirs lists every power_supply device of type Battery.
+func batteryDirs() ([]string, error) {
+	entries, err := os.ReadDir(powerSupplyDir())
+	if err != nil {
+		return nil, fmt.Errorf("can't scan %s: %w", powerSupplyDir(), err)
+	}
+
+	var dirs []string
+	for _, e := range entries {
+		dir := filepath.Join(powerSupplyDir(), e.Name())
+		if kind, err := ReadSysfs(filepath.Join(dir, "type")); err == nil && kind == "Battery" {
+			dirs = append(dirs, dir)
+		}
+	}
+
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("no battery found in %s", powerSupplyDir())
+	}
+	return dirs, nil
+}
+
+// PluggedIn tells whether any Mains adapter is online and names the first
+// one, docks and USB-C can bring several.
+func PluggedIn() (string, bool) {
+	entries, err := os.ReadDir(powerSupplyDir())
+	if err != nil {
+		return "", false
+	}
+	for _, e := range entries {
+		dir := filepath.Join(powerSupplyDir(), e.Name())
+		if kind, err := ReadSysfs(filepath.Join(dir, "type")); err != nil || kind != "Mains" {
+			continue
+		}
+		if online, err := ReadSysfs(filepath.Join(dir, "online")); err == nil && online == "1" {
+			return e.Name(), true
+		}
+	}
+	return "", false
+}
+
+// CheckBattery makes sure name is one of the detected batteries, listing
+// them when it isn't.
+func CheckBattery(name string) error {
+	dirs, err := batteryDirs()
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, dir := range dirs {
+		if filepath.Base(dir) == name {
+			return nil
+		}
+		names = append(names, filepath.Base(dir))
+	}
+	return fmt.Errorf("%s isn't a battery, detected %s", name, strings.Join(names, ", "))
+}
+
+// detectPath picks the battery with the highest energy_full, so
+// BAT1/CMB0 and friends work as well as BAT0. With a pinned battery that's
+// the one regardless.
+func (b *Battery) detectPath() (string, error) {
+	if b.pinned != "" {
+		dir := filepath.Join(powerSupplyDir(), b.pinned)
+		if _, err := os.Stat(dir); err != nil {
+			return "", fmt.Errorf("pinned battery %s: %w", b.pinned, err)
+		}
+		return dir, nil
+	}
+
+	dirs, err := batteryDirs()
+	if err != nil {
+		return "", err
+	}
+
+	best, bestEnergy := "", -1
+	for _, dir := range dirs {
+		energy := 0
+		if content, err := ReadSysfs(filepath.Join(dir, "energy_full")); err == nil {
+			energy, _ = strconv.Atoi(content)
+		}
+		if energy > bestEnergy {
+			best, bestEnergy = dir, energy
+		}
+	}
+	return best, nil
+}
+
+// Resolve runs detection and caches the result, so the hot path doesn't
+// rescan /sys/class/power_supply on every tick.
+func (b *Battery) Resolve() error {
+	path, err := b.detectPath()
+	if err != nil {
+		return err
+	}
+	paths := []string{path}
+	if b.pinned == "" {
+		if dirs, err := batteryDirs(); err == nil {
+			paths = dirs
+		}
+	}
+	b.path, b.paths = path, paths
+	return nil
+}
+
+// resolved resolves the battery unless that already happened, for reads
+// made while another BatterySource does the capacity.
+func (b *Battery) resolved() error {
+	if b.path != "" {
+		return nil
+	}
+	return b.Resolve()
+}
+
+// withBatteries runs read against the cached paths, resolving them again
+// once if the device went away, e.g. after a module reload renumbered it.
+func withBatteries[T any](b *Battery, read func() (T, error)) (T, error) {
+	if err := b.resolved(); err != nil {
+		var zero T
+		return zero, err
+	}
+
+	v, err := read()
+	if errors.Is(err, fs.ErrNotExist) {
+		old := b.path
+		if err := b.Resolve(); err == nil {
+			slog.Info("Re-resolved battery path", "old", old, "new", b.path)
+			return read()
+		}
+	}
+	return v, err
+}
+
+// Present is false once the battery is pulled from a modular bay, either
+// its directory goes away or present reads 0.
+func (b *Battery) Present() bool {
+	if _, err := os.Stat(b.path); b.path == "" || err != nil {
+		if err := b.Resolve(); err != nil {
+			return false
+		}
+	}
+	present, err := ReadSysfs(filepath.Join(b.path, "present"))
+	return err != nil || present != "0"
+}
+
+// Capacity is the sysfs backend's capacity, battery_backend = "gio" goes
+// through battery.Level() instead so both readings share one source.
+func (b *Battery) Capacity() (uint, error) {
+	return withBatteries(b, func() (uint, error) {
+		if len(b.paths) > 1 {
+			if capacity, ok := aggregateCapacity(b.paths); ok {
+				return uint(capacity), nil
+			}
+		}
+
+		raw, err := ReadSysfs(filepath.Join(b.path, "capacity"))
+		if errors.Is(err, fs.ErrNotExist) {
+			// older drivers only export charge_* or energy_*
+			if capacity, ok := aggregateCapacity([]string{b.path}); ok {
+				return uint(capacity), nil
+			}
+		}
+		if err != nil {
+			return 0, err
+		}
+		capacity, err := parseCapacity(raw)
+		return uint(capacity), err
+	})
+}
+
+// parseCapacity takes a percentage the way drivers hand it out, "80",
+// "080" or "80%", and refuses anything that isn't one.
+func parseCapacity(raw string) (int, error) {
+	digits := strings.TrimRightFunc(strings.TrimSpace(raw), func(r rune) bool {
+		return !unicode.IsDigit(r)
+	})
+	if digits == "" {
+		return 0, fmt.Errorf("capacity %q isn't a number", raw)
+	}
+	capacity, err := strconv.Atoi(digits)
+	if err != nil {
+		return 0, fmt.Errorf("capacity %q isn't a number", raw)
+	}
+	if capacity < 0 || capacity > 100 {
+		return 0, fmt.Errorf("capacity %q is outside 0..100", raw)
+	}
+	return capacity, nil
+}
+
+// Charging tells whether the battery, or any of them when none is pinned,
+// reports Charging in its status.
+func (b *Battery) Charging() (bool, error) {
+	return withBatteries(b, func() (bool, error) {
+		var lastErr error
+		for _, dir := range b.paths {
+			status, err := ReadSysfs(filepath.Join(dir, "status"))
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if status == "Charging" {
+				return true, nil
+			}
+		}
+		return false, lastErr
+	})
+}
+
+// aggregateCapacity is the combined percentage of several batteries, from
+// energy_* or, failing that, charge_* so bigger batteries weigh more.
+func aggregateCapacity(dirs []string) (int, bool) {
+	for _, unit := range []string{"energy", "charge"} {
+		var now, full int
+		ok := true
+		for _, dir := range dirs {
+			n, errNow := readSysfsInt(filepath.Join(dir, unit+"_now"))
+			f, errFull := readSysfsInt(filepath.Join(dir, unit+"_full"))
+			if errNow != nil || errFull != nil {
+				ok = false
+				break
+			}
+			now, full = now+n, full+f
+		}
+		if ok && full > 0 {
+			return (now*100 + full/2) / full, true
+		}
+	}
+	return 0, false
+}
+
+// Health is how much of its design capacity the battery still holds, in
+// percent.
+func (b *Battery) Health() (float64, error) {
+	if err := b.resolved(); err != nil {
+		return 0, err
+	}
+	for _, unit := range []string{"energy", "charge"} {
+		full, err := readSysfsInt(filepath.Join(b.path, unit+"_full"))
+		if err != nil {
+			continue
+		}
+		design, err := readSysfsInt(filepath.Join(b.path, unit+"_full_design"))
+		if err != nil || design <= 0 {
+			return 0, fmt.Errorf("%s_full_design isn't available", unit)
+		}
+		return float64(full) * 100 / float64(design), nil
+	}
+	return 0, fmt.Errorf("neither energy_full nor charge_full in %s", b.path)
+}
+
+// errETAUnknown is when there's no current flowing to estimate from.
+var errETAUnknown = errors.New("no charge or discharge current")
+
+// ETA estimates the time until full when charging, or until empty
+// otherwise, from power_now with energy_* or current_now with charge_*.
+func (b *Battery) ETA() (eta time.Duration, charging bool, err error) {
+	if err := b.resolved(); err != nil {
+		return 0, false, err
+	}
+	status, err := ReadSysfs(filepath.Join(b.path, "status"))
+	if err != nil {
+		return 0, false, err
+	}
+	charging = status == "Charging"
+
+	rate, now, full, err := b.chargeRate()
+	if err != nil {
+		return 0, charging, err
+	}
+	left := now
+	if charging {
+		left = full - now
+	}
+	return time.Duration(float64(left) / float64(rate) * float64(time.Hour)), charging, nil
+}
+
+// timeToLevel estimates how long charging takes to reach level at the
+// current rate, also returned in µW or µA.
+func (b *Battery) timeToLevel(level uint) (time.Duration, int, error) {
+	rate, now, full, err := b.chargeRate()
+	if err != nil {
+		return 0, 0, err
+	}
+	goal := full * int(level) / 100
+	if goal <= now {
+		return 0, rate, nil
+	}
+	return time.Duration(float64(goal-now) / float64(rate) * float64(time.Hour)), rate, nil
+}
+
+// chargeRate is power_now with energy_* or current_now with charge_*,
+// whichever the driver has, unsigned.
+func (b *Battery) chargeRate() (rate, now, full int, err error) {
+	if err := b.resolved(); err != nil {
+		return 0, 0, 0, err
+	}
+	for _, set := range [][3]string{{"power_now", "energy_now", "energy_full"}, {"current_now", "charge_now", "charge_full"}} {
+		rate, err := readSysfsInt(filepath.Join(b.path, set[0]))
+		if err != nil {
+			continue
+		}
+		now, errNow := readSysfsInt(filepath.Join(b.path, set[1]))
+		full, errFull := readSysfsInt(filepath.Join(b.path, set[2]))
+		if errNow != nil || errFull != nil {
+			continue
+		}
+		if rate < 0 { // some drivers sign the current
+			rate = -rate
+		}
+		if rate == 0 {
+			return 0, 0, 0, errETAUnknown
+		}
+		return rate, now, full, nil
+	}
+	return 0, 0, 0, fmt.Errorf("no power_now or current_now in %s", b.path)
+}
+
+// Identity is what the driver tells about the battery itself, any of it
+// may be missing.
+type Identity struct {
+	Manufacturer string `json:"manufacturer,omitempty"`
+	Model        string `json:"model,omitempty"`
+	Serial       string `json:"serial,omitempty"`
+	Technology   string `json:"technology,omitempty"`
+}
+
+// Identity reads what the driver tells about the battery.
+func (b *Battery) Identity() Identity {
+	read := func(name string) string {
+		value, _ := ReadSysfs(filepath.Join(b.path, name))
+		return value
+	}
+	return Identity{
+		Manufacturer: read("manufacturer"),
+		Model:        read("model_name"),
+		Serial:       read("serial_number"),
+		Technology:   read("technology"),
+	}
+}
+
+// Temperature is in °C, drivers report tenths of a degree.
+func (b *Battery) Temperature() (float64, error) {
+	if err := b.resolved(); err != nil {
+		return 0, err
+	}
+	temp, err := readSysfsInt(filepath.Join(b.path, "temp"))
+	if err != nil {
+		return 0, err
+	}
+	return float64(temp) / 10, nil
+}
+
+func readSysfsInt(path string) (int, error) {
+	content, err := ReadSysfs(path)
+	if err != nil {
+		return 0, err
+	}
+	if content == "" {
+		// some drivers leave attributes empty until the EC reports them
+		return 0, fmt.Errorf("%s is empty", path)
+	}
+	return strconv.Atoi(content)
+}
+
+// ReadSysfs reads a sysfs attribute without its trailing newline.
+func ReadSysfs(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	value := strings.TrimSpace(string(content))
+	slog.Log(context.Background(), LevelTrace, "Read sysfs value", "path", path, "value", value)
+	return value, nil
+}
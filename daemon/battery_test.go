@@ -0,0 +1,118 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package daemon
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadSysfs(t *testing.T) {
+	fakeSysfs(t)
+	for _, tc := range []struct {
+		raw, want string
+	}{
+		{"80\n", "80"},
+		{"Charging\n", "Charging"},
+		{"", ""},
+		{"\n", ""},
+	} {
+		path := writeNode(t, "class/power_supply/BAT0/attr", tc.raw)
+		got, err := ReadSysfs(path)
+		if err != nil || got != tc.want {
+			t.Errorf("ReadSysfs(%q) = %q, %v, want %q", tc.raw, got, err, tc.want)
+		}
+	}
+}
+
+func TestReadSysfsInt(t *testing.T) {
+	fakeSysfs(t)
+	for _, tc := range []struct {
+		raw  string
+		want int
+		ok   bool
+	}{
+		{"45000000\n", 45000000, true},
+		{"-1200\n", -1200, true},
+		{"", 0, false},
+		{"\n", 0, false},
+		{"n/a\n", 0, false},
+	} {
+		path := writeNode(t, "class/power_supply/BAT0/attr", tc.raw)
+		got, err := readSysfsInt(path)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("readSysfsInt(%q) = %d, %v, want %d ok %t", tc.raw, got, err, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestBatteryReadsFakeSysfs(t *testing.T) {
+	fakeSysfs(t)
+	writeNode(t, "class/power_supply/AC/type", "Mains\n")
+	writeNode(t, "class/power_supply/BAT0/type", "Battery\n")
+	capacity := writeNode(t, "class/power_supply/BAT0/capacity", "76 \n")
+	status := writeNode(t, "class/power_supply/BAT0/status", "Charging\n")
+	b := NewBattery("")
+
+	if got, err := b.Capacity(); err != nil || got != 76 {
+		t.Errorf("Capacity with trailing whitespace = %d, %v, want 76", got, err)
+	}
+	if got, err := b.Charging(); err != nil || !got {
+		t.Errorf("Charging = %t, %v, want true", got, err)
+	}
+	if b.Path() != filepath.Join(powerSupplyDir(), "BAT0") {
+		t.Errorf("Path = %s, want BAT0 and not the adapter", b.Path())
+	}
+
+	writeNode(t, "class/power_supply/BAT0/status", "Not charging\n")
+	if got, err := b.Charging(); err != nil || got {
+		t.Errorf("Charging at %q = %t, %v, want false", readNode(t, status), got, err)
+	}
+
+	for _, raw := range []string{"abc\n", "\n", "150\n"} {
+		writeNode(t, "class/power_supply/BAT0/capacity", raw)
+		if got, err := b.Capacity(); err == nil {
+			t.Errorf("Capacity of %q = %d, want a parse error", readNode(t, capacity), got)
+		}
+	}
+}
+
+func TestParseCapacity(t *testing.T) {
+	for _, tc := range []struct {
+		raw  string
+		want int
+		ok   bool
+	}{
+		{"80\n", 80, true},
+		{"80%", 80, true},
+		{"080", 80, true},
+		{"100 %\n", 100, true},
+		{"", 0, false},
+		{"%", 0, false},
+		{"full", 0, false},
+		{"101", 0, false},
+	} {
+		got, err := parseCapacity(tc.raw)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("parseCapacity(%q) = %d, %v, want %d ok %t", tc.raw, got, err, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestETAResolvesBattery(t *testing.T) {
+	fakeSysfs(t)
+	writeNode(t, "class/power_supply/BAT1/type", "Battery\n")
+	writeNode(t, "class/power_supply/BAT1/status", "Discharging\n")
+	writeNode(t, "class/power_supply/BAT1/power_now", "10000000\n")
+	writeNode(t, "class/power_supply/BAT1/energy_now", "20000000\n")
+	writeNode(t, "class/power_supply/BAT1/energy_full", "40000000\n")
+
+	// nothing read the capacity first, ETA finds the battery itself
+	eta, charging, err := NewBattery("").ETA()
+	if err != nil || charging || eta != 2*time.Hour {
+		t.Errorf("ETA = %s, charging %t, %v, want 2h discharging", eta, charging, err)
+	}
+}
@@ -0,0 +1,33 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package daemon
+
+import "time"
+
+// clockSample reads the three clocks ticks are compared by: the monotonic
+// one stops over suspend, boot time doesn't, and the wall clock can also be
+// stepped by NTP or by hand.
+type clockSample struct {
+	mono time.Time
+	wall time.Time
+	boot time.Duration
+}
+
+func sampleClocks() clockSample {
+	now := time.Now()
+	return clockSample{mono: now, wall: now.Round(0), boot: bootTime()}
+}
+
+// since splits the time from prev into time spent suspended and how far
+// the wall clock jumped. Without boot time every wall clock gap counts as
+// suspend, like it always did.
+func (c clockSample) since(prev clockSample) (asleep, jump time.Duration) {
+	awake := c.mono.Sub(prev.mono)
+	if c.boot == 0 || prev.boot == 0 {
+		return c.wall.Sub(prev.wall) - awake, 0
+	}
+	elapsed := c.boot - prev.boot
+	return elapsed - awake, c.wall.Sub(prev.wall) - elapsed
+}
@@ -0,0 +1,19 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package daemon
+
+import (
+	"golang.org/x/sys/unix"
+	"time"
+)
+
+// bootTime is CLOCK_BOOTTIME, 0 if the kernel doesn't have it.
+func bootTime() time.Duration {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_BOOTTIME, &ts); err != nil {
+		return 0
+	}
+	return time.Duration(ts.Nano())
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+/*
+Copyright © 2024 offeex
+*/
+
+package daemon
+
+import "time"
+
+// bootTime is 0 off linux, so every wall clock gap counts as suspend.
+func bootTime() time.Duration {
+	return 0
+}
@@ -0,0 +1,342 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"github.com/knadh/koanf/parsers/json"
+	"github.com/knadh/koanf/parsers/toml"
+	"github.com/knadh/koanf/parsers/yaml"
+	"github.com/knadh/koanf/providers/env"
+	"github.com/knadh/koanf/providers/file"
+	"github.com/knadh/koanf/providers/structs"
+	"github.com/knadh/koanf/v2"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Config is everything config.toml and the BATHEART_ variables can set.
+type Config struct {
+	Threshold      uint          `koanf:"threshold"`
+	StartThreshold uint          `koanf:"start_threshold"`
+	StopThreshold  uint          `koanf:"stop_threshold"`
+	ConservePath   string        `koanf:"conserve_path"`
+	ConservePaths  []string      `koanf:"conserve_paths"`
+	DryRun         bool          `koanf:"dry_run"`
+	Notify         bool          `koanf:"notify"`
+	LogLevel       string        `koanf:"log_level"`
+	LogFormat      string        `koanf:"log_format"`
+	LogFile        string        `koanf:"log_file"`
+	LogMaxSizeMB   uint          `koanf:"log_max_size_mb"`
+	LogMaxBackups  uint          `koanf:"log_max_backups"`
+	MetricsAddr    string        `koanf:"metrics_addr"`
+	HealthAddr     string        `koanf:"health_addr"`
+	Battery        string        `koanf:"battery"`
+	PrimaryBattery string        `koanf:"primary_battery"`
+	BatteryBackend string        `koanf:"battery_backend"`
+	Events         bool          `koanf:"events"`
+	ReloadDebounce time.Duration `koanf:"reload_debounce"`
+	OnExit         string        `koanf:"on_exit"`
+	PidFile        string        `koanf:"pid_file"`
+	// in °C, 0 disables the check
+	MaxTemp         float64   `koanf:"max_temp"`
+	MaxTempConserve bool      `koanf:"max_temp_conserve"`
+	Profiles        []Profile `koanf:"profiles"`
+	OnEnableCmd     string    `koanf:"on_enable_cmd"`
+	OnDisableCmd    string    `koanf:"on_disable_cmd"`
+	// normal, well below the threshold, and charging right at it
+	PollInterval     time.Duration `koanf:"poll_interval"`
+	IdleInterval     time.Duration `koanf:"idle_interval"`
+	ConvergeInterval time.Duration `koanf:"converge_interval"`
+	// notify below this percentage while discharging, 0 disables it
+	NotifyLow uint `koanf:"notify_low"`
+	// what threshold hardware gets written, 0 writes the threshold itself.
+	// Some firmware only takes a few values like 60, 80 and 100
+	TargetPercent uint `koanf:"target_percent"`
+	// below this conservation is forced off, 0 disables it
+	LowFloor uint `koanf:"low_floor"`
+	// how far below the threshold to start polling at converge_interval,
+	// and the width of the band comparison
+	Tolerance uint `koanf:"tolerance"`
+	// how capacity is held against the threshold: gte, band or exact
+	Comparison string `koanf:"comparison"`
+	// conservation stays off this long after the daemon starts
+	StartupGrace time.Duration `koanf:"startup_grace"`
+	// least time between conservation changes, 0 disables it
+	MinToggleInterval time.Duration `koanf:"min_toggle_interval"`
+	// extra writes when a conservation write doesn't read back
+	WriteRetries uint `koanf:"write_retries"`
+	// stop thresholds by the Mains adapter that's online, e.g. ADP1
+	AdapterThresholds map[string]uint `koanf:"adapter_thresholds"`
+	// register org.batheart.Daemon on the session bus
+	DBus bool `koanf:"dbus"`
+	// average the capacity over this many readings for decisions, logs keep
+	// the raw value
+	SmoothingWindow uint `koanf:"smoothing_window"`
+	// start-first, stop-first or auto for hardware with both thresholds
+	ThresholdOrder string `koanf:"threshold_order"`
+	// write every control found instead of just the first
+	ApplyAllControls bool `koanf:"apply_all_controls"`
+	// read and report the battery but never touch conservation mode
+	MonitorOnly bool `koanf:"monitor_only"`
+	// storage holds the battery at storage_threshold for long-term storage,
+	// over profiles and adapters. It only caps charging, a battery already
+	// above it stays there until it's used
+	Storage          bool `koanf:"storage"`
+	StorageThreshold uint `koanf:"storage_threshold"`
+	// written verbatim to toggle nodes like conservation_mode
+	ConserveOnValue  string `koanf:"conserve_on_value"`
+	ConserveOffValue string `koanf:"conserve_off_value"`
+}
+
+// StopAt is where charging should stop, stop_threshold if it's set
+// and the plain threshold otherwise.
+func (c *Config) StopAt() uint {
+	if c.StopThreshold != 0 {
+		return c.StopThreshold
+	}
+	return c.Threshold
+}
+
+// PinnedBattery is the battery decisions are based on, primary_battery
+// and battery both pin one, "" aggregates them all.
+func (c *Config) PinnedBattery() string {
+	if c.PrimaryBattery != "" {
+		return c.PrimaryBattery
+	}
+	return c.Battery
+}
+
+// withAdapter takes the stop threshold from adapter_thresholds when the
+// online adapter has one, falling back to the configured threshold.
+func (c *Config) withAdapter(adapter string) *Config {
+	threshold, ok := c.AdapterThresholds[adapter]
+	if adapter == "" || !ok {
+		return c
+	}
+	effective := *c
+	effective.StopThreshold = threshold
+	return &effective
+}
+
+// withStorage swaps the stop threshold for storage_threshold, dropping a
+// start threshold or target_percent that wouldn't fit under it.
+func (c *Config) withStorage() *Config {
+	effective := *c
+	effective.Threshold, effective.StopThreshold = c.StorageThreshold, 0
+	if effective.StartThreshold >= c.StorageThreshold {
+		effective.StartThreshold = 0
+	}
+	if effective.TargetPercent > c.StorageThreshold {
+		effective.TargetPercent = 0
+	}
+	return &effective
+}
+
+// satSub is a - b clamped at 0, uint thresholds would wrap otherwise.
+func satSub(a, b uint) uint {
+	if a < b {
+		return 0
+	}
+	return a - b
+}
+
+func (c *Config) validate() error {
+	if c.Threshold < 1 || c.Threshold > 100 {
+		return fmt.Errorf("threshold %d is outside 1..100", c.Threshold)
+	}
+	if _, err := ParseLogLevel(c.LogLevel); err != nil {
+		return err
+	}
+	if c.LogFormat != "" && c.LogFormat != "text" && c.LogFormat != "json" {
+		return fmt.Errorf("log_format %q must be text or json", c.LogFormat)
+	}
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"poll_interval", c.PollInterval},
+		{"idle_interval", c.IdleInterval},
+		{"converge_interval", c.ConvergeInterval},
+	} {
+		if d.value <= 0 {
+			return fmt.Errorf("%s %s must be positive", d.name, d.value)
+		}
+	}
+	if c.Battery != "" && c.PrimaryBattery != "" && c.Battery != c.PrimaryBattery {
+		return errors.New("set either battery or primary_battery, not both")
+	}
+	if c.ConservePath != "" && len(c.ConservePaths) > 0 {
+		return errors.New("set either conserve_path or conserve_paths, not both")
+	}
+	for adapter, threshold := range c.AdapterThresholds {
+		if threshold < 1 || threshold > 100 || threshold <= c.StartThreshold {
+			return fmt.Errorf("adapter_thresholds.%s %d must be in 1..100 and above start_threshold", adapter, threshold)
+		}
+	}
+	if c.TargetPercent > 100 || (c.TargetPercent != 0 && c.TargetPercent <= c.StartThreshold) {
+		return fmt.Errorf("target_percent %d must be in 1..100 and above start_threshold", c.TargetPercent)
+	}
+	if c.NotifyLow > 100 {
+		return fmt.Errorf("notify_low %d is above 100", c.NotifyLow)
+	}
+	if c.LowFloor != 0 && c.LowFloor >= c.StopAt() {
+		return fmt.Errorf("low_floor %d must be below the threshold %d", c.LowFloor, c.StopAt())
+	}
+	if c.StorageThreshold < 1 || c.StorageThreshold > 100 || c.StorageThreshold <= max(c.LowFloor, c.Tolerance) {
+		return fmt.Errorf("storage_threshold %d must be in 1..100 and above low_floor and tolerance", c.StorageThreshold)
+	}
+	if c.ConserveOnValue == "" || c.ConserveOffValue == "" || c.ConserveOnValue == c.ConserveOffValue {
+		return fmt.Errorf("conserve_on_value %q and conserve_off_value %q must be set and differ", c.ConserveOnValue, c.ConserveOffValue)
+	}
+	if c.Tolerance >= c.StopAt() {
+		return fmt.Errorf("tolerance %d must be below the threshold %d", c.Tolerance, c.StopAt())
+	}
+	if c.StartupGrace < 0 {
+		return fmt.Errorf("startup_grace %s can't be negative", c.StartupGrace)
+	}
+	if c.MinToggleInterval < 0 {
+		return fmt.Errorf("min_toggle_interval %s can't be negative", c.MinToggleInterval)
+	}
+	if c.ReloadDebounce < 0 {
+		return fmt.Errorf("reload_debounce %s can't be negative", c.ReloadDebounce)
+	}
+	switch c.OnExit {
+	case "", "leave", "enable", "disable":
+	default:
+		return fmt.Errorf("on_exit %q must be leave, enable or disable", c.OnExit)
+	}
+	switch c.BatteryBackend {
+	case "", "sysfs", "gio", "upower":
+	default:
+		return fmt.Errorf("battery_backend %q must be sysfs, gio or upower", c.BatteryBackend)
+	}
+	switch c.ThresholdOrder {
+	case "", "start-first", "stop-first", "auto":
+	default:
+		return fmt.Errorf("threshold_order %q must be start-first, stop-first or auto", c.ThresholdOrder)
+	}
+	switch c.Comparison {
+	case "", "gte", "band", "exact":
+	default:
+		return fmt.Errorf("comparison %q must be gte, band or exact", c.Comparison)
+	}
+	for _, p := range c.Profiles {
+		if err := p.validate(c.StartThreshold); err != nil {
+			return err
+		}
+	}
+	if c.StartThreshold == 0 && c.StopThreshold == 0 {
+		return nil
+	}
+	if c.StopThreshold > 100 {
+		return fmt.Errorf("stop_threshold %d is above 100", c.StopThreshold)
+	}
+	if c.StartThreshold >= c.StopAt() {
+		return fmt.Errorf("start_threshold %d must be below stop_threshold %d", c.StartThreshold, c.StopAt())
+	}
+	return nil
+}
+
+// ParserFor picks the config format from the file extension, TOML unless
+// it's YAML or JSON.
+func ParserFor(path string) koanf.Parser {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return yaml.Parser()
+	case ".json":
+		return json.Parser()
+	}
+	return toml.Parser()
+}
+
+// envPrefix vars override the file, BATHEART_LOG_LEVEL=debug sets
+// log_level: the prefix is dropped and the rest lowercased.
+const envPrefix = "BATHEART_"
+
+func envProvider() *env.Env {
+	return env.Provider(envPrefix, ".", func(s string) string {
+		return strings.ToLower(strings.TrimPrefix(s, envPrefix))
+	})
+}
+
+// LoadConfig layers the defaults, the file at path and the BATHEART_
+// variables. errHandler gets the result of loading the file, returning nil
+// carries on without it.
+func LoadConfig(path string, errHandler func(err error) error) (*Config, error) {
+	k := koanf.New(".")
+	// defaults first so keys missing from the file keep their default
+	_ = k.Load(structs.Provider(defaultConfig(), "koanf"), nil)
+	if err := errHandler(k.Load(file.Provider(path), ParserFor(path))); err != nil {
+		return nil, err
+	}
+	if err := k.Load(envProvider(), nil); err != nil {
+		return nil, fmt.Errorf("load env: %w", err)
+	}
+
+	var cfg Config
+
+	if err := k.Unmarshal("", &cfg); err != nil {
+		return nil, fmt.Errorf("parse: %w", err)
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("validate: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Threshold:        80,
+		LogLevel:         "info",
+		LogFormat:        "text",
+		LogMaxSizeMB:     10,
+		LogMaxBackups:    3,
+		BatteryBackend:   "sysfs",
+		Events:           true,
+		ReloadDebounce:   time.Millisecond * 500,
+		OnExit:           "leave",
+		PollInterval:     time.Minute * 5,
+		IdleInterval:     time.Minute * 10,
+		ConvergeInterval: time.Second * 10,
+		Tolerance:        1,
+		Comparison:       "gte",
+		WriteRetries:     2,
+		ThresholdOrder:   "start-first",
+		StorageThreshold: 55,
+		ConserveOnValue:  "1",
+		ConserveOffValue: "0",
+	}
+}
+
+// DefaultConfig is what batheart runs with when config.toml sets nothing.
+func DefaultConfig() Config {
+	return *defaultConfig()
+}
+
+// LevelTrace is below debug, for every sysfs read.
+const LevelTrace = slog.LevelDebug - 4
+
+// ParseLogLevel is the slog level a log_level value stands for.
+func ParseLogLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "trace":
+		return LevelTrace, nil
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("log_level %q must be one of trace, debug, info, warn, error", name)
+}
@@ -0,0 +1,108 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateThreshold(t *testing.T) {
+	for _, tc := range []struct {
+		threshold uint
+		ok        bool
+	}{
+		{0, false},
+		{1, false}, // tolerance 1 has to stay below it
+		{2, true},
+		{80, true},
+		{100, true},
+		{101, false},
+	} {
+		cfg := defaultConfig()
+		cfg.Threshold = tc.threshold
+		if err := cfg.validate(); (err == nil) != tc.ok {
+			t.Errorf("threshold %d: validate = %v, want ok %t", tc.threshold, err, tc.ok)
+		}
+	}
+}
+
+func TestSatSub(t *testing.T) {
+	for _, tc := range []struct{ a, b, want uint }{
+		{80, 1, 79},
+		{1, 1, 0},
+		{0, 1, 0},
+		{3, 5, 0},
+	} {
+		if got := satSub(tc.a, tc.b); got != tc.want {
+			t.Errorf("satSub(%d, %d) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestBandDoesNotWrapAtLowThreshold(t *testing.T) {
+	// a threshold at the tolerance would wrap threshold-tolerance around to
+	// the top of uint without satSub, and match every capacity
+	cfg := defaultConfig()
+	cfg.Threshold, cfg.Tolerance, cfg.Comparison = 1, 2, "band"
+	for capacity, want := range map[uint]bool{0: true, 3: true, 4: false, 50: false, 100: false} {
+		if enable, _, _ := decideConservation(capacity, false, false, cfg); enable != want {
+			t.Errorf("band around 1±2 at %d%%: enable %t, want %t", capacity, enable, want)
+		}
+	}
+}
+
+// writeConfig writes data to a config.toml in a temp dir for LoadConfig.
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigKeepsDefaults(t *testing.T) {
+	cfg, err := LoadConfig(writeConfig(t, "threshold = 90\n"), func(err error) error { return err })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Threshold != 90 {
+		t.Errorf("threshold = %d, want 90", cfg.Threshold)
+	}
+	defaults := defaultConfig()
+	for _, f := range []struct {
+		key       string
+		got, want any
+	}{
+		{"log_level", cfg.LogLevel, defaults.LogLevel},
+		{"poll_interval", cfg.PollInterval, defaults.PollInterval},
+		{"idle_interval", cfg.IdleInterval, defaults.IdleInterval},
+		{"converge_interval", cfg.ConvergeInterval, defaults.ConvergeInterval},
+		{"tolerance", cfg.Tolerance, defaults.Tolerance},
+		{"comparison", cfg.Comparison, defaults.Comparison},
+		{"events", cfg.Events, defaults.Events},
+		{"on_exit", cfg.OnExit, defaults.OnExit},
+		{"storage_threshold", cfg.StorageThreshold, defaults.StorageThreshold},
+		{"conserve_on_value", cfg.ConserveOnValue, defaults.ConserveOnValue},
+	} {
+		if f.got != f.want {
+			t.Errorf("%s = %v, want the default %v", f.key, f.got, f.want)
+		}
+	}
+}
+
+func TestEnvOverridesFile(t *testing.T) {
+	t.Setenv("BATHEART_THRESHOLD", "75")
+	cfg, err := LoadConfig(writeConfig(t, "threshold = 90\n"), func(err error) error { return err })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Threshold != 75 {
+		t.Errorf("threshold = %d with BATHEART_THRESHOLD=75 over the file's 90, want 75", cfg.Threshold)
+	}
+}
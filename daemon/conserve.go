@@ -0,0 +1,477 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// conserveCandidates are globbed in order when conserve_path isn't set.
+// The ideapad node is a 0/1 toggle, the rest take a percentage, a stop one
+// unless only the start threshold exists. ASUS names its battery BAT0,
+// BAT1, BATT or BATC depending on the model.
+func conserveCandidates() []string {
+	return []string{
+		filepath.Join(sysfsRoot, "bus/platform/drivers/ideapad_acpi/*/conservation_mode"),
+		filepath.Join(powerSupplyDir(), "BAT*/charge_control_end_threshold"), // thinkpad, asus, huawei
+		filepath.Join(powerSupplyDir(), "CMB*/charge_control_end_threshold"),
+		filepath.Join(powerSupplyDir(), "BAT*/charge_control_start_threshold"), // samsung, lg
+	}
+}
+
+// writeRetryDelay gives the EC a moment before writing again
+const writeRetryDelay = time.Millisecond * 200
+
+// DiscoverConservePath is the first control conserveCandidates matches.
+func DiscoverConservePath() (string, error) {
+	candidates := conserveCandidates()
+	for _, pattern := range candidates {
+		matches, _ := filepath.Glob(pattern)
+		if len(matches) > 0 {
+			return matches[0], nil
+		}
+	}
+	return "", fmt.Errorf("no conservation control found, checked %s", strings.Join(candidates, ", "))
+}
+
+// discoverAllConservePaths is every control conserveCandidates matches,
+// leaving out start thresholds already written along with their stop one.
+func discoverAllConservePaths() []string {
+	var paths []string
+	for _, pattern := range conserveCandidates() {
+		matches, _ := filepath.Glob(pattern)
+		for _, path := range matches {
+			if ConserveKindOf(path) == ConserveStartOnly && StartNodePath(filepath.Join(filepath.Dir(path), "charge_control_end_threshold")) != "" {
+				continue
+			}
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// ResolveConservePath is the control cfg points at, conserve_path or the
+// first of conserve_paths that exists, or else the one discovered.
+func ResolveConservePath(cfg *Config) (string, error) {
+	if cfg.ConservePath != "" {
+		return cfg.ConservePath, nil
+	}
+	if len(cfg.ConservePaths) > 0 {
+		for _, path := range cfg.ConservePaths {
+			if _, err := os.Stat(path); err == nil {
+				return path, nil
+			}
+		}
+		return "", fmt.Errorf("none of conserve_paths exist: %s", strings.Join(cfg.ConservePaths, ", "))
+	}
+	return DiscoverConservePath()
+}
+
+// ConserveKind is how a conservation control takes its value.
+type ConserveKind int
+
+const (
+	// a 0/1 switch like ideapad's conservation_mode
+	ConserveToggle ConserveKind = iota
+	// a stop percentage like charge_control_end_threshold on thinkpad/asus
+	ConserveThreshold
+	// only charge_control_start_threshold, charging doesn't begin until the
+	// level drops below it, as on some samsung and lg models
+	ConserveStartOnly
+)
+
+func (k ConserveKind) String() string {
+	switch k {
+	case ConserveThreshold:
+		return "threshold"
+	case ConserveStartOnly:
+		return "start-only"
+	}
+	return "toggle"
+}
+
+// armedByFirmware tells whether the hardware enforces the limit itself, so
+// conservation just stays enabled instead of following the threshold.
+func (d *Daemon) armedByFirmware() bool {
+	return d.upower != nil || ConserveKindOf(d.conservePath) != ConserveToggle
+}
+
+// ConserveKindOf tells the kind of control from the node's name.
+func ConserveKindOf(path string) ConserveKind {
+	switch filepath.Base(path) {
+	case "conservation_mode":
+		return ConserveToggle
+	case "charge_control_start_threshold":
+		return ConserveStartOnly
+	}
+	return ConserveThreshold
+}
+
+// ConservationEnabled reads the node back, a threshold node counts as
+// enabled below 100.
+func ConservationEnabled(path string, cfg *Config) (bool, error) {
+	if ConserveKindOf(path) == ConserveToggle {
+		value, err := ReadSysfs(path)
+		if err != nil {
+			return false, err
+		}
+		on, _ := toggleValues(path, cfg)
+		return value == on, nil
+	}
+	value, err := readSysfsInt(path)
+	if err != nil {
+		return false, err
+	}
+	return value < 100, nil
+}
+
+// togglePairs are the on/off spellings toggle drivers are known to use.
+var togglePairs = [][2]string{{"1", "0"}, {"on", "off"}, {"enabled", "disabled"}}
+
+// toggleValues is what a toggle node takes for on and off. Values set in
+// the config are used as they are; only the defaults give way to a known
+// spelling when the node holds neither.
+func toggleValues(path string, cfg *Config) (on, off string) {
+	on, off = cfg.ConserveOnValue, cfg.ConserveOffValue
+	if defaults := defaultConfig(); on != defaults.ConserveOnValue || off != defaults.ConserveOffValue {
+		return on, off
+	}
+	current, err := ReadSysfs(path)
+	if err != nil || current == on || current == off {
+		return on, off
+	}
+	for _, pair := range togglePairs {
+		if current == pair[0] || current == pair[1] {
+			slog.Debug("Toggle node uses other values than configured", "path", path, "on", pair[0], "off", pair[1])
+			return pair[0], pair[1]
+		}
+	}
+	return on, off
+}
+
+// StartNodePath is the charge_control_start_threshold next to a stop
+// threshold node, or "" when the hardware only has the one control.
+func StartNodePath(path string) string {
+	if filepath.Base(path) != "charge_control_end_threshold" {
+		return ""
+	}
+	start := filepath.Join(filepath.Dir(path), "charge_control_start_threshold")
+	if _, err := os.Stat(start); err != nil {
+		return ""
+	}
+	return start
+}
+
+// restrictedTargets are drivers whose stop threshold only takes a few
+// values and refuses the rest with EINVAL, by their name in /sys/module.
+var restrictedTargets = []struct {
+	module string
+	values []uint
+}{
+	{"lg_laptop", []uint{80, 100}},
+	{"toshiba_acpi", []uint{80, 100}},
+}
+
+// allowedTargets is what the stop threshold at path takes when the driver
+// behind it is one of restrictedTargets, nil when anything in 1..100 goes.
+func allowedTargets(path string) (module string, values []uint) {
+	if ConserveKindOf(path) != ConserveThreshold {
+		return "", nil
+	}
+	for _, r := range restrictedTargets {
+		if _, err := os.Stat(filepath.Join(sysfsRoot, "module", r.module)); err == nil {
+			return r.module, r.values
+		}
+	}
+	return "", nil
+}
+
+// setConservationMode switches a toggle node, or writes target to a
+// threshold node (100 when disabled so it charges fully).
+func (d *Daemon) setConservationMode(b bool, target uint, cfg *Config) error {
+	if cfg.DryRun || d.DryRun {
+		slog.Info("Dry run, would set conservation mode", "enabled", b, "target", target)
+		return nil
+	}
+
+	if d.upower != nil {
+		return d.upower.setChargeThreshold(b)
+	}
+
+	var err error
+	d.conservePath, err = writeControls(d.conservePath, b, target, cfg)
+	return err
+}
+
+// SetConservation sets conservation mode on path the way the daemon would,
+// honoring dry_run, conserve_paths and apply_all_controls.
+func SetConservation(path string, b bool, target uint, cfg *Config) error {
+	if cfg.DryRun {
+		slog.Info("Dry run, would set conservation mode", "enabled", b, "target", target)
+		return nil
+	}
+	_, err := writeControls(path, b, target, cfg)
+	return err
+}
+
+// writeControls writes path, or the controls cfg lists instead, and
+// returns the control to use from now on.
+func writeControls(path string, b bool, target uint, cfg *Config) (string, error) {
+	if cfg.ApplyAllControls {
+		paths := cfg.ConservePaths
+		if len(paths) == 0 {
+			paths = discoverAllConservePaths()
+		}
+		return path, writeAllConservation(paths, b, target, cfg)
+	}
+	if len(cfg.ConservePaths) > 0 {
+		return writeFirstConservation(path, cfg.ConservePaths, b, target, cfg)
+	}
+
+	err := writeConservation(path, b, target, cfg)
+	if errors.Is(err, fs.ErrNotExist) && cfg.ConservePath == "" {
+		// the node can vanish and come back elsewhere when the module reloads
+		if found, derr := DiscoverConservePath(); derr == nil {
+			slog.Info("Re-resolved conservation control", "old", path, "new", found)
+			return found, writeConservation(found, b, target, cfg)
+		}
+	}
+	return path, err
+}
+
+// writeFirstConservation tries each of conserve_paths in order and keeps
+// the first one that takes the write.
+func writeFirstConservation(current string, paths []string, b bool, target uint, cfg *Config) (string, error) {
+	var errs []error
+	for _, path := range paths {
+		err := writeConservation(path, b, target, cfg)
+		if err == nil {
+			if path != current {
+				slog.Info("Using conservation control", "path", path, "kind", ConserveKindOf(path))
+			}
+			return path, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", path, err))
+	}
+	return current, fmt.Errorf("every path in conserve_paths failed: %w", errors.Join(errs...))
+}
+
+// writeAllConservation writes every control for firmware that only honors
+// some of them, failing only when none took it.
+func writeAllConservation(paths []string, b bool, target uint, cfg *Config) error {
+	if len(paths) == 0 {
+		return errors.New("no conservation control found")
+	}
+	var errs []error
+	for _, path := range paths {
+		if err := writeConservation(path, b, target, cfg); err != nil {
+			slog.Warn("Conservation control write failed", "path", path, "err", err)
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+		}
+	}
+	if len(errs) == len(paths) {
+		return fmt.Errorf("no conservation control took the write: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+func writeConservation(path string, b bool, target uint, cfg *Config) error {
+	if ConserveKindOf(path) == ConserveToggle {
+		on, off := toggleValues(path, cfg)
+		enabled := off
+		if b {
+			enabled = on
+		}
+		if err := writeVerified(path, enabled, cfg.WriteRetries); err != nil {
+			return fmt.Errorf("can't change conservation mode: %w", err)
+		}
+		return nil
+	}
+
+	if ConserveKindOf(path) == ConserveStartOnly {
+		// hold off charging until the level drops below the start value,
+		// 100 lets it charge whenever it's plugged in
+		start := uint(100)
+		if b {
+			start = target
+			if cfg.StartThreshold != 0 {
+				start = cfg.StartThreshold
+			}
+		}
+		if start > 100 {
+			return fmt.Errorf("start threshold %d is outside 0..100", start)
+		}
+		if err := writeVerified(path, strconv.Itoa(int(start)), cfg.WriteRetries); err != nil {
+			return fmt.Errorf("can't change start threshold: %w", err)
+		}
+		return nil
+	}
+
+	start, stop := uint(0), uint(100)
+	if b {
+		start, stop = cfg.StartThreshold, target
+	}
+
+	startPath := StartNodePath(path)
+	if startPath == "" {
+		if err := writeVerified(path, strconv.Itoa(int(stop)), cfg.WriteRetries); err != nil {
+			return fmt.Errorf("can't change conservation mode: %w", err)
+		}
+		return nil
+	}
+
+	steps := []struct{ name, path, value string }{
+		{"start", startPath, strconv.Itoa(int(start))},
+		{"stop", path, strconv.Itoa(int(stop))},
+	}
+	if stopFirst(cfg.ThresholdOrder, path, start) {
+		steps[0], steps[1] = steps[1], steps[0]
+	}
+
+	var errs []error
+	for _, step := range steps {
+		slog.Debug("Writing charge threshold", "threshold", step.name, "path", step.path, "value", step.value)
+		if err := writeVerified(step.path, step.value, cfg.WriteRetries); err != nil {
+			errs = append(errs, fmt.Errorf("%s threshold: %w", step.name, err))
+		}
+	}
+	if len(errs) == 0 {
+		// some ECs nudge one threshold when the other changes
+		for _, step := range steps {
+			if got, err := ReadSysfs(step.path); err != nil || got != step.value {
+				errs = append(errs, fmt.Errorf("%s threshold reads back %q instead of %q", step.name, got, step.value))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("can't change charge thresholds: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// stopFirst tells whether the stop threshold goes before the start one.
+// Firmware rejects a start at or above the current stop, so auto writes the
+// stop first whenever the new start wouldn't fit under the old stop.
+func stopFirst(order, path string, start uint) bool {
+	switch order {
+	case "stop-first":
+		return true
+	case "auto":
+		current, err := readSysfsInt(path)
+		return err == nil && int(start) >= current
+	}
+	return false
+}
+
+// PreflightConservePath checks up front that the node exists and that we
+// may write it, rather than finding out on the first failed write.
+func PreflightConservePath(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	for _, p := range []string{path, StartNodePath(path)} {
+		if p == "" {
+			continue
+		}
+		if err := unix.Access(p, unix.W_OK); err != nil {
+			return &os.PathError{Op: "write", Path: p, Err: err}
+		}
+	}
+	return nil
+}
+
+// writeVerified reads the node back after writing, some EC firmware drops
+// writes and needs another go or two.
+func writeVerified(path, value string, retries uint) error {
+	for attempt := uint(1); ; attempt++ {
+		if err := writeSysfs(path, value); err != nil {
+			return err
+		}
+		got, err := ReadSysfs(path)
+		if err != nil {
+			return err
+		}
+		if got == value {
+			return nil
+		}
+		if attempt > retries {
+			return fmt.Errorf("%s reads back %q instead of %q after %d writes", path, got, value, attempt)
+		}
+		slog.Warn("Sysfs write didn't stick, retrying", "path", path, "want", value, "got", got, "attempt", attempt)
+		time.Sleep(writeRetryDelay)
+	}
+}
+
+// writeSysfs writes value unless the node already holds it, so re-applying
+// the same mode every few minutes doesn't touch the hardware.
+func writeSysfs(path, value string) error {
+	if current, err := ReadSysfs(path); err == nil && current == value {
+		slog.Debug("Sysfs value already set", "path", path, "value", value)
+		return nil
+	}
+
+	if err := os.WriteFile(path, []byte(value), 0644); err != nil {
+		return err
+	}
+	slog.Debug("Wrote sysfs value", "path", path, "value", value)
+	return nil
+}
+
+// VerifyConservationWrite flips conservation mode on path, reads it back
+// and puts the nodes back exactly as they were. It returns whether
+// conservation was enabled before.
+func VerifyConservationWrite(path string, cfg *Config) (bool, error) {
+	enabled, err := ConservationEnabled(path, cfg)
+	if err != nil {
+		return false, err
+	}
+	nodes := []string{path}
+	if start := StartNodePath(path); start != "" {
+		nodes = append(nodes, start)
+	}
+	original := map[string]string{}
+	for _, node := range nodes {
+		if original[node], err = ReadSysfs(node); err != nil {
+			return false, err
+		}
+	}
+
+	writeErr := writeConservation(path, !enabled, cfg.StopAt(), cfg)
+	if writeErr == nil {
+		if got, err := ConservationEnabled(path, cfg); err != nil {
+			writeErr = err
+		} else if got == enabled {
+			writeErr = fmt.Errorf("%s still reads enabled %t after the write", path, enabled)
+		}
+	}
+
+	// the stop threshold can't go below the start one, so write whichever
+	// fits first
+	if len(nodes) == 2 {
+		start, _ := strconv.Atoi(original[nodes[1]])
+		if !stopFirst("auto", path, uint(max(start, 0))) {
+			nodes[0], nodes[1] = nodes[1], nodes[0]
+		}
+	}
+	var restoreErrs []error
+	for _, node := range nodes {
+		if err := writeVerified(node, original[node], cfg.WriteRetries); err != nil {
+			restoreErrs = append(restoreErrs, fmt.Errorf("%s: %w", filepath.Base(node), err))
+		}
+	}
+	if len(restoreErrs) > 0 {
+		return false, fmt.Errorf("can't restore conservation mode: %w", errors.Join(append(restoreErrs, writeErr)...))
+	}
+	return enabled, writeErr
+}
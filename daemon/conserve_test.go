@@ -0,0 +1,127 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteVerified(t *testing.T) {
+	fakeSysfs(t)
+	path := writeNode(t, "bus/platform/drivers/ideapad_acpi/VPC2004:00/conservation_mode", "0\n")
+
+	if err := writeVerified(path, "1", 0); err != nil {
+		t.Fatalf("writeVerified = %v", err)
+	}
+	if got := readNode(t, path); got != "1" {
+		t.Errorf("conservation_mode = %q after writing 1", got)
+	}
+
+	// the read back is trimmed, so this never matches, like an EC ignoring
+	// the write
+	err := writeVerified(path, "0 ", 0)
+	if err == nil || !strings.Contains(err.Error(), "reads back") {
+		t.Errorf("writeVerified with a value that doesn't read back = %v, want a read-back error", err)
+	}
+
+	if err := writeVerified(filepath.Join(sysfsRoot, "missing/conservation_mode"), "1", 0); err == nil {
+		t.Error("writeVerified to a missing node succeeded")
+	}
+}
+
+func TestSetConservationToggle(t *testing.T) {
+	cfg := testConfig(t)
+	for _, enable := range []bool{true, false, true} {
+		if err := SetConservation(cfg.ConservePath, enable, 80, &cfg); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ConservationEnabled(cfg.ConservePath, &cfg)
+		if err != nil || got != enable {
+			t.Errorf("ConservationEnabled after setting %t = %t, %v", enable, got, err)
+		}
+	}
+}
+
+func TestCheckTargetRestrictedDriver(t *testing.T) {
+	fakeSysfs(t)
+	if err := os.MkdirAll(filepath.Join(sysfsRoot, "module/lg_laptop"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.ConservePath = writeNode(t, "class/power_supply/BAT0/charge_control_end_threshold", "100")
+	cfg.Events = false
+	cfg.StorageThreshold = 80
+
+	for _, tc := range []struct {
+		threshold, target uint
+		ok                bool
+	}{
+		{80, 0, true},
+		{85, 0, false},
+		{75, 80, true},
+		{80, 60, false},
+		{80, 100, true},
+	} {
+		c := cfg
+		c.Threshold, c.TargetPercent = tc.threshold, tc.target
+		err := New(c, NewFakeBattery(50, false)).setup()
+		if (err == nil) != tc.ok {
+			t.Errorf("threshold %d target_percent %d on lg_laptop: setup = %v, want ok %t", tc.threshold, tc.target, err, tc.ok)
+		}
+	}
+
+	// every stop value that gets written at some point has to fit too
+	for key, change := range map[string]func(c *Config){
+		"storage_threshold":  func(c *Config) { c.StorageThreshold = 55 },
+		"profile threshold":  func(c *Config) { c.Profiles = []Profile{{Name: "night", Start: "22:00", End: "06:00", Threshold: 60}} },
+		"adapter_thresholds": func(c *Config) { c.AdapterThresholds = map[string]uint{"ADP1": 90} },
+	} {
+		c := cfg
+		change(&c)
+		if err := New(c, NewFakeBattery(50, false)).setup(); err == nil || !strings.Contains(err.Error(), "lg_laptop") {
+			t.Errorf("%s lg_laptop doesn't take: setup = %v, want it refused", key, err)
+		}
+	}
+	c := cfg
+	c.Profiles = []Profile{{Name: "trip", Start: "06:00", End: "08:00", Threshold: 100}}
+	c.AdapterThresholds = map[string]uint{"ADP1": 80}
+	if err := New(c, NewFakeBattery(50, false)).setup(); err != nil {
+		t.Errorf("profile at 100 and adapter at 80 on lg_laptop: setup = %v", err)
+	}
+
+	// anything goes where the driver isn't known to be picky
+	if err := os.Remove(filepath.Join(sysfsRoot, "module/lg_laptop")); err != nil {
+		t.Fatal(err)
+	}
+	c = cfg
+	c.TargetPercent = 60
+	if err := New(c, NewFakeBattery(50, false)).setup(); err != nil {
+		t.Errorf("target_percent 60 without a restricted driver: setup = %v", err)
+	}
+}
+
+func TestToggleValues(t *testing.T) {
+	cfg := testConfig(t)
+	writeNode(t, "bus/platform/drivers/ideapad_acpi/VPC2004:00/conservation_mode", "on\n")
+	if on, off := toggleValues(cfg.ConservePath, &cfg); on != "on" || off != "off" {
+		t.Errorf("toggleValues at the defaults on a node reading on = %q/%q, want on/off", on, off)
+	}
+
+	// configured values are written verbatim even when the node holds a
+	// known spelling
+	cfg.ConserveOnValue, cfg.ConserveOffValue = "yes", "no"
+	if on, off := toggleValues(cfg.ConservePath, &cfg); on != "yes" || off != "no" {
+		t.Errorf("toggleValues with yes/no configured = %q/%q, want yes/no", on, off)
+	}
+	if err := SetConservation(cfg.ConservePath, true, 80, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := readNode(t, cfg.ConservePath); got != "yes" {
+		t.Errorf("conservation_mode = %q after enabling with yes/no configured, want yes", got)
+	}
+}
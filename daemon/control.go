@@ -0,0 +1,219 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package daemon
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// controlRequest is one command read from the control socket, answered by
+// the daemon loop since it owns the state.
+type controlRequest struct {
+	cmd   string
+	reply chan string
+}
+
+// where root keeps its runtime files when started outside a login session
+const systemRuntimeDir = "/run/batheart"
+
+// RuntimeDir is where the control socket and the instance lock live,
+// XDG_RUNTIME_DIR or /run/batheart for root. Both are private to their
+// owner, there's deliberately no fallback to a shared dir like /tmp.
+func RuntimeDir() (string, error) {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return dir, nil
+	}
+	if os.Geteuid() != 0 {
+		return "", errors.New("XDG_RUNTIME_DIR isn't set, only root falls back to " + systemRuntimeDir)
+	}
+	if err := os.MkdirAll(systemRuntimeDir, 0o700); err != nil {
+		return "", err
+	}
+	return systemRuntimeDir, nil
+}
+
+// ControlSocketPath is the socket a running daemon takes commands on.
+func ControlSocketPath() (string, error) {
+	dir, err := RuntimeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "batheart.sock"), nil
+}
+
+// listenControl serves the control socket, one command per connection.
+func listenControl(requests chan<- controlRequest) (stop func(), err error) {
+	path, err := ControlSocketPath()
+	if err != nil {
+		return nil, err
+	}
+	// Run may be called without the instance lock, so only take over a
+	// socket nobody is listening on any more
+	if conn, err := net.DialTimeout("unix", path, time.Second*2); err == nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("another daemon is listening on %s", path)
+	} else if errors.Is(err, unix.ECONNREFUSED) {
+		_ = os.Remove(path)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("check %s: %w", path, err)
+	}
+
+	// the socket starts out with the umask's permissions, keep it private
+	// from the start rather than only after the chmod
+	umask := unix.Umask(0o177)
+	ln, err := net.Listen("unix", path)
+	unix.Umask(umask)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return // closed by stop
+			}
+			go serveControl(conn, requests)
+		}
+	}()
+
+	return func() {
+		_ = ln.Close()
+		_ = os.Remove(path)
+	}, nil
+}
+
+func serveControl(conn net.Conn, requests chan<- controlRequest) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(time.Second * 10))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+
+	req := controlRequest{cmd: strings.TrimSpace(line), reply: make(chan string, 1)}
+	slog.Debug("Control command", "cmd", req.cmd)
+	requests <- req
+	_, _ = fmt.Fprintln(conn, <-req.reply)
+}
+
+// SendControl is the client side, it returns the daemon's reply.
+func SendControl(cmd string) (string, error) {
+	path, err := ControlSocketPath()
+	if err != nil {
+		return "", fmt.Errorf("can't reach the daemon: %w", err)
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second*2)
+	if err != nil {
+		return "", fmt.Errorf("can't reach the daemon: %w", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(time.Second * 10))
+
+	if _, err := fmt.Fprintln(conn, cmd); err != nil {
+		return "", err
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && reply == "" {
+		return "", err
+	}
+	return strings.TrimSpace(reply), nil
+}
+
+// control is st.control with a runtime threshold held to the same checks
+// as one from the config, so it can't get written where cfg's couldn't.
+func (d *Daemon) control(st *daemonState, cfg *Config, cmd string) (reevaluate bool, err error) {
+	arg, ok := strings.CutPrefix(cmd, "threshold ")
+	if !ok {
+		return st.control(cmd)
+	}
+	threshold, err := strconv.ParseUint(arg, 10, 0)
+	if err != nil || threshold > 100 {
+		return false, fmt.Errorf("threshold %q must be 0..100, 0 for the configured one", arg)
+	}
+	candidate := (&daemonState{threshold: uint(threshold)}).withThreshold(cfg)
+	if err := candidate.validate(); err != nil {
+		return false, err
+	}
+	if d.conservePath != "" {
+		if err := checkTarget(d.conservePath, candidate); err != nil {
+			return false, err
+		}
+	}
+	st.threshold = uint(threshold)
+	st.force = true
+	return true, nil
+}
+
+// control applies a command to the loop state and tells whether the
+// battery has to be evaluated again for it to take effect.
+func (st *daemonState) control(cmd string) (reevaluate bool, err error) {
+	if arg, ok := strings.CutPrefix(cmd, "storage"); ok && (arg == "" || arg[0] == ' ') {
+		// plain storage turns it on, storage config goes back to the option
+		switch strings.TrimSpace(arg) {
+		case "", "on":
+			on := true
+			st.storage = &on
+		case "off":
+			off := false
+			st.storage = &off
+		case "config":
+			st.storage = nil
+		default:
+			return false, fmt.Errorf("%q must be storage on, off or config", cmd)
+		}
+		st.force = true
+		return true, nil
+	}
+
+	switch cmd {
+	case "status":
+		return false, nil
+	case "enable", "disable":
+		manual := cmd == "enable"
+		st.manual, st.chargeFull = &manual, false
+	case "toggle":
+		manual := !st.conserving
+		st.manual, st.chargeFull = &manual, false
+	case "auto":
+		st.manual, st.chargeFull = nil, false
+	case "charge-full":
+		st.manual, st.chargeFull = nil, true
+	default:
+		return false, errors.New("unknown command " + cmd)
+	}
+	st.force = true
+	return true, nil
+}
+
+func (st *daemonState) describe() string {
+	mode := "auto"
+	switch {
+	case st.manual != nil:
+		mode = "manual"
+	case st.chargeFull:
+		mode = "charge-full"
+	}
+	profile := st.profile
+	if profile == "" {
+		profile = "default"
+	}
+	return fmt.Sprintf("level=%d charging=%t conservation=%t mode=%s profile=%s", st.prevLevel, st.charging, st.conserving, mode, profile)
+}
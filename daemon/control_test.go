@@ -0,0 +1,135 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package daemon
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestControlSocketIsPrivate(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	stop, err := listenControl(make(chan controlRequest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	path, err := ControlSocketPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0o600 {
+		t.Errorf("socket mode = %o, want 600", mode)
+	}
+}
+
+func TestRuntimeDirWithoutXDG(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", "")
+	dir, err := RuntimeDir()
+	if os.Geteuid() == 0 {
+		if err != nil || dir != systemRuntimeDir {
+			t.Errorf("RuntimeDir as root = %q, %v, want %s", dir, err, systemRuntimeDir)
+		}
+		return
+	}
+	if err == nil {
+		t.Errorf("RuntimeDir = %q, want an error instead of a shared dir", dir)
+	}
+}
+
+func TestListenControlKeepsRunningDaemonsSocket(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	stop, err := listenControl(make(chan controlRequest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	if second, err := listenControl(make(chan controlRequest)); err == nil {
+		second()
+		t.Fatal("listenControl took over a socket that's still served")
+	}
+	path, err := ControlSocketPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := net.Dial("unix", path); err != nil {
+		t.Errorf("first daemon's socket is gone: %v", err)
+	}
+}
+
+func TestListenControlReplacesStaleSocket(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	path, err := ControlSocketPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// left behind by a daemon that died without cleaning up
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = ln.Close()
+
+	stop, err := listenControl(make(chan controlRequest))
+	if err != nil {
+		t.Fatalf("listenControl over a stale socket = %v", err)
+	}
+	stop()
+}
+
+func TestControlThresholdIsValidated(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.StartThreshold = 70
+	d := newTestDaemon(t, cfg, NewFakeBattery(50, false))
+
+	for _, tc := range []struct {
+		cmd string
+		ok  bool
+	}{
+		{"threshold 90", true},
+		{"threshold 70", false}, // at start_threshold
+		{"threshold 60", false},
+		{"threshold 101", false},
+		{"threshold 0", true},
+	} {
+		st := daemonState{}
+		_, err := d.control(&st, d.cfg, tc.cmd)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s with start_threshold 70: %v, want ok %t", tc.cmd, err, tc.ok)
+		}
+		if err != nil && st.threshold != 0 {
+			t.Errorf("%s was refused but still set the threshold to %d", tc.cmd, st.threshold)
+		}
+	}
+}
+
+func TestControlThresholdOnRestrictedDriver(t *testing.T) {
+	fakeSysfs(t)
+	if err := os.MkdirAll(filepath.Join(sysfsRoot, "module/lg_laptop"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.ConservePath = writeNode(t, "class/power_supply/BAT0/charge_control_end_threshold", "100")
+	cfg.Events = false
+	cfg.StorageThreshold = 80
+	d := newTestDaemon(t, cfg, NewFakeBattery(50, false))
+
+	st := daemonState{}
+	if _, err := d.control(&st, d.cfg, "threshold 85"); err == nil || st.threshold != 0 {
+		t.Errorf("threshold 85 on lg_laptop = %v, threshold %d, want it refused", err, st.threshold)
+	}
+	if _, err := d.control(&st, d.cfg, "threshold 100"); err != nil || st.threshold != 100 {
+		t.Errorf("threshold 100 on lg_laptop = %v, threshold %d, want it taken", err, st.threshold)
+	}
+}
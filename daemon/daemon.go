@@ -0,0 +1,467 @@
+/*
+Copyright © 2024 offeex
+*/
+
+// Package daemon is the battery conservation loop behind batheart, for
+// tools embedding it instead of running the binary.
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/knadh/koanf/providers/file"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	conserveRetryInterval = time.Second * 30
+	maxReadBackoff        = time.Minute * 15
+	// how often to try watching the config again after losing the watch
+	rewatchInterval = time.Second
+	// this much time suspended between ticks means we resumed
+	suspendGap = time.Minute
+	// wall clock steps above this re-check profiles, NTP slews smaller ones
+	clockJumpGap = time.Second * 10
+)
+
+// Daemon is the conservation loop without the CLI around it. Set the
+// exported fields before calling Run.
+type Daemon struct {
+	// watched and reloaded on changes when set, see Reload
+	ConfigPath string
+	// log conservation changes without writing them, over dry_run
+	DryRun bool
+	// called with every config Reload picked up, e.g. to set up logging again
+	OnReload func(cfg *Config)
+
+	cfg     *Config
+	src     BatterySource
+	battery *Battery
+	// resolved once in setupControl, see ResolveConservePath
+	conservePath string
+	// no conservation control was found, only read the battery
+	monitor bool
+	// set when UPower handles conservation instead of conservePath
+	upower *upowerBattery
+	stats  metrics
+
+	// the watcher runs on its own goroutine, so swap configs atomically
+	// and have the loop pick up the current one on every tick
+	active atomic.Pointer[Config]
+	// the watcher and SIGHUP may fire together, only one reload at a time
+	reloadMu sync.Mutex
+	reloaded chan struct{}
+}
+
+// New makes a Daemon for cfg, src nil picks the source from
+// cfg.BatteryBackend.
+func New(cfg Config, src BatterySource) *Daemon {
+	d := &Daemon{cfg: &cfg, src: src, reloaded: make(chan struct{}, 1)}
+	d.active.Store(d.cfg)
+	return d
+}
+
+// Run finds the conservation control and evaluates the battery until ctx
+// is cancelled.
+func (d *Daemon) Run(ctx context.Context) error {
+	if err := d.setup(); err != nil {
+		return err
+	}
+	return d.run(ctx)
+}
+
+// Once evaluates the battery a single time, for cron or timers. It fails
+// when the battery can't be read or conservation mode can't be written,
+// monitoring or leaving conservation as is are fine.
+func (d *Daemon) Once() error {
+	if err := d.setup(); err != nil {
+		return err
+	}
+	// nothing to compare against yet, so nothing to short-circuit on
+	st := daemonState{force: true}
+	d.evaluate(d.cfg, &st)
+	return st.err
+}
+
+func (d *Daemon) setup() error {
+	if err := d.cfg.validate(); err != nil {
+		return fmt.Errorf("validate: %w", err)
+	}
+	d.battery = NewBattery(d.cfg.PinnedBattery())
+	if b, ok := d.src.(*Battery); ok {
+		d.battery = b
+	}
+	if d.src == nil {
+		slog.Info("Using battery backend", "backend", d.cfg.BatteryBackend)
+		d.src = newBatterySource(d.cfg.BatteryBackend, d.battery)
+	}
+	return d.setupControl(d.cfg)
+}
+
+// Reload reads ConfigPath again and has the loop apply it, keeping the
+// current config when the file is gone or broken.
+func (d *Daemon) Reload() {
+	d.reloadMu.Lock()
+	defer d.reloadMu.Unlock()
+
+	if d.ConfigPath == "" {
+		slog.Info("No config file to reload")
+		return
+	}
+	newCfg, err := LoadConfig(d.ConfigPath, func(err error) error { return err })
+	if err != nil {
+		// never fall back to defaults mid-run, e.g. while an editor or a
+		// user deleted the file
+		d.stats.configErrors.Add(1)
+		if errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Config file is gone, keeping the current config", "err", err)
+		} else {
+			slog.Warn("Config reload failed, keeping the current one", "err", err)
+		}
+		return
+	}
+	d.active.Store(newCfg)
+	d.stats.configReloads.Add(1)
+	if d.OnReload != nil {
+		d.OnReload(newCfg)
+	}
+	slog.Info("Config reloaded", "threshold", newCfg.StopAt())
+
+	select {
+	case d.reloaded <- struct{}{}:
+	default:
+	}
+}
+
+// setupControl picks what conservation gets written to, falling back to
+// monitoring when the hardware has nothing batheart knows of.
+func (d *Daemon) setupControl(cfg *Config) error {
+	if cfg.MonitorOnly {
+		slog.Info("Monitoring only, conservation mode is left alone")
+	} else if u, ok := d.src.(*upowerBattery); ok && u.thresholdSupported() {
+		d.upower = u
+		slog.Info("Using UPower charge threshold for conservation")
+	} else {
+		var err error
+		d.conservePath, err = ResolveConservePath(cfg)
+		switch {
+		case err != nil && (cfg.ConservePath != "" || len(cfg.ConservePaths) > 0):
+			return fmt.Errorf("can't find conservation mode control: %w", err)
+		case err != nil:
+			slog.Warn("This laptop has no conservation control batheart knows of, only monitoring the battery. "+
+				"Please open an issue with your laptop model so it can be supported", "checked", conserveCandidates())
+			d.monitor = true
+		default:
+			slog.Info("Using conservation control", "path", d.conservePath, "kind", ConserveKindOf(d.conservePath))
+			if err := checkTarget(d.conservePath, cfg); err != nil {
+				return err
+			}
+			if ConserveKindOf(d.conservePath) == ConserveToggle {
+				if on, off := toggleValues(d.conservePath, cfg); on != cfg.ConserveOnValue {
+					slog.Info("Conservation control takes other values than configured", "on", on, "off", off)
+				}
+			}
+		}
+
+		if !d.monitor && !cfg.DryRun && !d.DryRun {
+			if err := PreflightConservePath(d.conservePath); errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("conservation control is missing: %w", err)
+			} else if err != nil {
+				slog.Error("Run as root or add a udev rule granting write access to "+d.conservePath, "err", err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkTarget refuses stop thresholds the driver behind path won't take,
+// rather than have every write fail later. Profiles, adapters and storage
+// mode all get written at some point, so they're checked too.
+func checkTarget(path string, cfg *Config) error {
+	module, values := allowedTargets(path)
+	if values == nil {
+		return nil
+	}
+	for _, t := range stopTargets(cfg) {
+		if !slices.Contains(values, t.value) {
+			return fmt.Errorf("%s %d isn't taken by %s, which only accepts %v", t.key, t.value, module, values)
+		}
+	}
+	slog.Info("Conservation control only takes some values", "module", module, "values", values)
+	return nil
+}
+
+type stopTarget struct {
+	key   string
+	value uint
+}
+
+// stopTargets is every stop threshold cfg can have written, by the key
+// setting it. target_percent stands in for the thresholds it applies to.
+func stopTargets(cfg *Config) []stopTarget {
+	if cfg.TargetPercent != 0 {
+		targets := []stopTarget{{"target_percent", cfg.TargetPercent}}
+		if cfg.TargetPercent > cfg.StorageThreshold {
+			targets = append(targets, stopTarget{"storage_threshold", cfg.StorageThreshold})
+		}
+		return targets
+	}
+
+	targets := []stopTarget{{"threshold", cfg.StopAt()}}
+	for _, p := range cfg.Profiles {
+		targets = append(targets, stopTarget{fmt.Sprintf("profile %q threshold", p.Name), p.Threshold})
+	}
+	adapters := make([]string, 0, len(cfg.AdapterThresholds))
+	for adapter := range cfg.AdapterThresholds {
+		adapters = append(adapters, adapter)
+	}
+	slices.Sort(adapters)
+	for _, adapter := range adapters {
+		targets = append(targets, stopTarget{"adapter_thresholds." + adapter, cfg.AdapterThresholds[adapter]})
+	}
+	return append(targets, stopTarget{"storage_threshold", cfg.StorageThreshold})
+}
+
+// monitoring tells whether conservation mode is left alone, by config or
+// because there's nothing to write it to.
+func (d *Daemon) monitoring(cfg *Config) bool {
+	return cfg.MonitorOnly || d.monitor || (d.conservePath == "" && d.upower == nil)
+}
+
+// resolveControl sets up the conservation control for a reload turning
+// monitor_only off, setup skipped it while it was on. Until it works out
+// the daemon keeps monitoring.
+func (d *Daemon) resolveControl(cfg *Config) {
+	if cfg.MonitorOnly || d.monitor || d.upower != nil || d.conservePath != "" {
+		return
+	}
+	if err := d.setupControl(cfg); err != nil {
+		d.conservePath = ""
+		slog.Error("monitor_only is off but conservation mode can't be written, still monitoring", "err", err)
+	}
+}
+
+// run evaluates the battery until ctx is cancelled. Without a ConfigPath
+// there's no config file to watch.
+func (d *Daemon) run(ctx context.Context) error {
+	cfg := d.active.Load()
+
+	// editors tend to save in several steps, only reload after the last one
+	debounce := time.AfterFunc(time.Hour, func() {
+		slog.Info("Config changed, reloading!")
+		d.Reload()
+	})
+	debounce.Stop()
+	defer debounce.Stop()
+
+	// the provider gives up its watch once the file is removed, e.g. by
+	// editors saving through delete and create, so keep setting it up again
+	var (
+		watchMu  sync.Mutex
+		provider *file.File
+		// set on the way out, so a late rewatch doesn't start another one
+		unwatched bool
+		rewatch   *time.Timer
+	)
+	watch := func() error {
+		watchMu.Lock()
+		defer watchMu.Unlock()
+		if unwatched {
+			return nil
+		}
+		// the old provider's goroutine may still be winding down, a new
+		// one doesn't share any of its state
+		p := file.Provider(d.ConfigPath)
+		err := p.Watch(
+			func(event interface{}, err error) {
+				if err != nil {
+					slog.Warn("Lost the config watch, setting it up again", "err", err)
+					rewatch.Reset(rewatchInterval)
+					return
+				}
+
+				debounce.Reset(d.active.Load().ReloadDebounce)
+			},
+		)
+		if err == nil {
+			provider = p
+		}
+		return err
+	}
+	rewatch = time.AfterFunc(time.Hour, func() {
+		if err := watch(); err != nil {
+			slog.Debug("Config watch not back yet", "err", err)
+			rewatch.Reset(rewatchInterval)
+			return
+		}
+		slog.Info("Watching the config again")
+		// whatever replaced the file hasn't been read yet
+		debounce.Reset(d.active.Load().ReloadDebounce)
+	})
+	rewatch.Stop()
+	defer rewatch.Stop()
+
+	if d.ConfigPath != "" {
+		if err := watch(); err != nil {
+			// e.g. the default config couldn't be written, keep running on
+			// what we have and pick the file up once it's there
+			slog.Warn("Can't watch the config yet, trying again", "path", d.ConfigPath, "err", err)
+			rewatch.Reset(rewatchInterval)
+		}
+		defer func() {
+			watchMu.Lock()
+			defer watchMu.Unlock()
+			unwatched = true
+			if provider != nil {
+				_ = provider.Unwatch()
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(cfg.PollInterval)
+	defer ticker.Stop()
+	defer slog.Info("Batheart has been shut down")
+	defer func() { d.applyOnExit(d.active.Load()) }()
+	defer sdNotify("STOPPING=1")
+
+	routes := map[string]map[string]http.Handler{}
+	if cfg.MetricsAddr != "" {
+		routes[cfg.MetricsAddr] = map[string]http.Handler{"/metrics": &d.stats}
+	}
+	if cfg.HealthAddr != "" {
+		if routes[cfg.HealthAddr] == nil {
+			routes[cfg.HealthAddr] = map[string]http.Handler{}
+		}
+		// a tick may be an idle one, plus the slack for being late
+		routes[cfg.HealthAddr]["/healthz"] = d.stats.healthHandler(func() time.Duration {
+			c := d.active.Load()
+			return 2 * max(c.PollInterval, c.IdleInterval)
+		})
+	}
+	if len(routes) > 0 {
+		defer stopServers(startServers(routes))
+	}
+
+	// the ticker stays on as a heartbeat, uevents just make us react sooner
+	var uevents <-chan struct{}
+	if cfg.Events {
+		ch, stop, err := watchPowerSupply()
+		if err != nil {
+			slog.Warn("Can't subscribe to power supply events, polling only", "err", err)
+		} else {
+			defer stop()
+			uevents = ch
+		}
+	}
+
+	control := make(chan controlRequest)
+	if stop, err := listenControl(control); err != nil {
+		slog.Warn("Can't open the control socket", "err", err)
+	} else {
+		defer stop()
+	}
+
+	var watchdog <-chan time.Time
+	if interval := watchdogInterval(); interval > 0 {
+		watchdogTicker := time.NewTicker(interval)
+		defer watchdogTicker.Stop()
+		watchdog = watchdogTicker.C
+	}
+
+	// clocks at the last tick, so suspend and clock steps can be told apart
+	lastTick := sampleClocks()
+	resetTicker := func(d time.Duration) {
+		if d > 0 {
+			ticker.Reset(d)
+			lastTick = sampleClocks()
+		}
+	}
+
+	st := daemonState{started: time.Now()}
+
+	var bus *dbusService
+	if cfg.DBus {
+		var err error
+		if bus, err = startDBus(control); err != nil {
+			slog.Warn("Can't register on the session bus", "name", dbusName, "err", err)
+		} else {
+			defer bus.Close()
+		}
+	}
+	tick := func() {
+		resetTicker(d.evaluate(d.active.Load(), &st))
+		if bus != nil {
+			// the one evaluate went by, with profiles, adapters and storage
+			bus.update(&st, uint(d.stats.threshold.Load()))
+		}
+	}
+
+	slog.Info("Batheart have been enabled")
+	tick()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-d.reloaded:
+			d.resolveControl(d.active.Load())
+			st.force = true // re-apply with the new threshold
+			tick()
+		case <-uevents:
+			slog.Debug("Power supply changed")
+			st.force = true
+			tick()
+		case req := <-control:
+			reevaluate, err := d.control(&st, d.active.Load(), req.cmd)
+			if reevaluate {
+				tick()
+			}
+			if err != nil {
+				req.reply <- "error: " + err.Error()
+			} else {
+				req.reply <- st.describe()
+			}
+		case <-watchdog:
+			sdNotify("WATCHDOG=1")
+		case <-ticker.C:
+			now := sampleClocks()
+			asleep, jump := now.since(lastTick)
+			if asleep > suspendGap {
+				slog.Debug("Detected resume from suspend", "asleep", asleep)
+				st.readFailures = 0
+				st.readings = nil // the level moved on while asleep
+				st.force = true
+			}
+			if jump > clockJumpGap || jump < -clockJumpGap {
+				// profiles go by the wall clock, look at them again now
+				slog.Debug("Detected wall clock jump", "jump", jump)
+				st.force = true
+			}
+			lastTick = now
+			tick()
+		}
+	}
+}
+
+func (d *Daemon) applyOnExit(cfg *Config) {
+	if d.monitoring(cfg) {
+		return
+	}
+	if cfg.OnExit == "" || cfg.OnExit == "leave" {
+		slog.Info("Leaving conservation mode as is on exit")
+		return
+	}
+
+	enable := cfg.OnExit == "enable"
+	if err := d.setConservationMode(enable, cfg.StopAt(), cfg); err != nil {
+		slog.Error("Can't restore conservation mode on exit", "err", err)
+		return
+	}
+	slog.Info("Set conservation mode on exit", "enabled", enable)
+}
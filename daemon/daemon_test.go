@@ -0,0 +1,408 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeSysfs points sysfsRoot at an empty tree for the test, so nothing
+// reads or writes the real battery.
+func fakeSysfs(t *testing.T) string {
+	t.Helper()
+	prev := sysfsRoot
+	sysfsRoot = t.TempDir()
+	t.Cleanup(func() { sysfsRoot = prev })
+	if err := os.MkdirAll(powerSupplyDir(), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return sysfsRoot
+}
+
+// writeNode creates a sysfs node under the fake tree and returns its path.
+func writeNode(t *testing.T, rel, value string) string {
+	t.Helper()
+	path := filepath.Join(sysfsRoot, rel)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(value), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func readNode(t *testing.T, path string) string {
+	t.Helper()
+	value, err := ReadSysfs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+// testConfig is the default config writing a fake conservation_mode,
+// without uevents so nothing but the test drives the loop.
+func testConfig(t *testing.T) Config {
+	t.Helper()
+	fakeSysfs(t)
+	cfg := DefaultConfig()
+	cfg.ConservePath = writeNode(t, "bus/platform/drivers/ideapad_acpi/VPC2004:00/conservation_mode", "0")
+	cfg.Events = false
+	return cfg
+}
+
+// newTestDaemon sets d up the way Run does, without starting the loop.
+func newTestDaemon(t *testing.T, cfg Config, src BatterySource) *Daemon {
+	t.Helper()
+	d := New(cfg, src)
+	if err := d.setup(); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestEvaluateFollowsFakeBattery(t *testing.T) {
+	cfg := testConfig(t)
+	fake := NewFakeBattery(70, true)
+	d := newTestDaemon(t, cfg, fake)
+	st := daemonState{}
+
+	for _, step := range []struct {
+		level    uint
+		charging bool
+		want     string
+	}{
+		{70, true, "0"},
+		{79, true, "0"},
+		{80, true, "1"},
+		{85, false, "1"},
+		{60, false, "0"},
+	} {
+		fake.Set(step.level, step.charging)
+		d.evaluate(d.cfg, &st)
+		if got := readNode(t, cfg.ConservePath); got != step.want {
+			t.Errorf("at %d%% charging %t: conservation_mode = %q, want %q", step.level, step.charging, got, step.want)
+		}
+	}
+}
+
+func TestEvaluateBacksOffOnReadErrors(t *testing.T) {
+	cfg := testConfig(t)
+	fake := NewFakeBattery(90, true)
+	fake.Fail(os.ErrNotExist)
+	d := newTestDaemon(t, cfg, fake)
+	st := daemonState{}
+
+	if next := d.evaluate(d.cfg, &st); next != time.Minute {
+		t.Errorf("first failed read retries in %s, want %s", next, time.Minute)
+	}
+	if next := d.evaluate(d.cfg, &st); next != 2*time.Minute {
+		t.Errorf("second failed read retries in %s, want %s", next, 2*time.Minute)
+	}
+	if got := readNode(t, cfg.ConservePath); got != "0" {
+		t.Errorf("conservation_mode = %q after failed reads, want it untouched", got)
+	}
+
+	fake.Fail(nil)
+	d.evaluate(d.cfg, &st)
+	if got := readNode(t, cfg.ConservePath); got != "1" {
+		t.Errorf("conservation_mode = %q once readable at 90%%, want 1", got)
+	}
+}
+
+func TestEvaluateWaitsForPulledBattery(t *testing.T) {
+	cfg := testConfig(t)
+	fake := NewFakeBattery(90, false)
+	fake.Pull(true)
+	d := newTestDaemon(t, cfg, fake)
+	st := daemonState{}
+
+	if next := d.evaluate(d.cfg, &st); next != cfg.IdleInterval || !st.absent {
+		t.Errorf("pulled battery: next %s absent %t, want %s and absent", next, st.absent, cfg.IdleInterval)
+	}
+	fake.Pull(false)
+	d.evaluate(d.cfg, &st)
+	if got := readNode(t, cfg.ConservePath); got != "1" || st.absent {
+		t.Errorf("battery back at 90%%: conservation_mode = %q absent %t, want 1", got, st.absent)
+	}
+}
+
+func TestRunAppliesAndStops(t *testing.T) {
+	cfg := testConfig(t)
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	fake := NewFakeBattery(85, true)
+	d := New(cfg, fake)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- d.Run(ctx) }()
+
+	waitForNode(t, cfg.ConservePath, "1")
+
+	// control commands evaluate right away, no need to wait for a tick
+	fake.Set(60, false)
+	if _, err := SendControl("auto"); err != nil {
+		t.Fatal(err)
+	}
+	waitForNode(t, cfg.ConservePath, "0")
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after cancel")
+	}
+}
+
+// waitForNode polls path until it reads want, failing after a few seconds.
+func waitForNode(t *testing.T, path, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := readNode(t, path)
+		if got == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s = %q, want %q", path, got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// writeTestConfig writes a config.toml for Run to watch, using the fake
+// conservation_mode from cfg.
+func writeTestConfig(t *testing.T, path string, cfg Config, threshold uint) {
+	t.Helper()
+	data := fmt.Sprintf("threshold = %d\nconserve_path = %q\nevents = false\nreload_debounce = \"10ms\"\n", threshold, cfg.ConservePath)
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// runTestDaemon starts d.Run in the background and stops it again when
+// the test is over.
+func runTestDaemon(t *testing.T, d *Daemon) {
+	t.Helper()
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- d.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Run = %v", err)
+		}
+	})
+}
+
+func TestReloadAppliesNewThreshold(t *testing.T) {
+	cfg := testConfig(t)
+	path := filepath.Join(t.TempDir(), "config.toml")
+	writeTestConfig(t, path, cfg, 80)
+	loaded, err := LoadConfig(path, func(err error) error { return err })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := New(*loaded, NewFakeBattery(85, true))
+	d.ConfigPath = path
+	runTestDaemon(t, d)
+	waitForNode(t, cfg.ConservePath, "1")
+
+	// 85% is below the new threshold, so charging goes on
+	writeTestConfig(t, path, cfg, 90)
+	waitForNode(t, cfg.ConservePath, "0")
+	if got := d.active.Load().Threshold; got != 90 {
+		t.Errorf("threshold after reload = %d, want 90", got)
+	}
+}
+
+func TestSIGTERMStopsRun(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.OnExit = "disable"
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	d := New(cfg, NewFakeBattery(85, true))
+
+	// the way Execute wires it
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	done := make(chan error, 1)
+	go func() { done <- d.Run(ctx) }()
+	waitForNode(t, cfg.ConservePath, "1")
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after SIGTERM")
+	}
+	if got := readNode(t, cfg.ConservePath); got != "0" {
+		t.Errorf("conservation_mode = %q after SIGTERM with on_exit = disable, want 0", got)
+	}
+}
+
+func TestOnceInMonitorMode(t *testing.T) {
+	fakeSysfs(t)
+	cfg := DefaultConfig()
+	// nothing under the fake sysfs to discover, so it only monitors
+	if err := New(cfg, NewFakeBattery(85, true)).Once(); err != nil {
+		t.Errorf("Once without a conservation control = %v, want nil", err)
+	}
+}
+
+func TestOnce(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		level   uint
+		monitor bool
+		readErr error
+		initial string
+		want    string
+		ok      bool
+	}{
+		{"applies", 85, false, nil, "0", "1", true},
+		{"empty battery", 0, false, nil, "1", "0", true},
+		{"monitor_only", 85, true, nil, "0", "0", true},
+		{"read error", 85, false, os.ErrNotExist, "0", "0", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.MonitorOnly = tc.monitor
+			writeNode(t, "bus/platform/drivers/ideapad_acpi/VPC2004:00/conservation_mode", tc.initial)
+			fake := NewFakeBattery(tc.level, false)
+			fake.Fail(tc.readErr)
+
+			err := New(cfg, fake).Once()
+			if (err == nil) != tc.ok {
+				t.Errorf("Once = %v, want ok %t", err, tc.ok)
+			}
+			if got := readNode(t, cfg.ConservePath); got != tc.want {
+				t.Errorf("conservation_mode = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDeletedConfigKeepsThreshold(t *testing.T) {
+	cfg := testConfig(t)
+	path := filepath.Join(t.TempDir(), "config.toml")
+	writeTestConfig(t, path, cfg, 90)
+	loaded, err := LoadConfig(path, func(err error) error { return err })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// starts out enabled, so seeing it disabled means the loop is running
+	writeNode(t, "bus/platform/drivers/ideapad_acpi/VPC2004:00/conservation_mode", "1")
+	d := New(*loaded, NewFakeBattery(85, true))
+	d.ConfigPath = path
+	runTestDaemon(t, d)
+	waitForNode(t, cfg.ConservePath, "0")
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	// what SIGHUP does, the file being gone mustn't bring back the defaults
+	d.Reload()
+	if got := d.active.Load().Threshold; got != 90 {
+		t.Errorf("threshold after deleting the config = %d, want 90 kept", got)
+	}
+	if got := d.stats.configErrors.Load(); got != 1 {
+		t.Errorf("config errors = %d, want 1", got)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := readNode(t, cfg.ConservePath); got != "0" {
+		t.Errorf("conservation_mode = %q at 85%% with threshold 90 kept, want 0", got)
+	}
+
+	// once it's back the watch picks it up again
+	writeTestConfig(t, path, cfg, 80)
+	waitForNode(t, cfg.ConservePath, "1")
+}
+
+func TestReloadAfterRenameOverConfig(t *testing.T) {
+	cfg := testConfig(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.toml")
+	writeTestConfig(t, path, cfg, 80)
+	loaded, err := LoadConfig(path, func(err error) error { return err })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := New(*loaded, NewFakeBattery(85, true))
+	d.ConfigPath = path
+	runTestDaemon(t, d)
+	waitForNode(t, cfg.ConservePath, "1")
+
+	// how editors save, a new file renamed over the old one
+	tmp := filepath.Join(dir, ".config.toml.swp")
+	writeTestConfig(t, tmp, cfg, 90)
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	waitForNode(t, cfg.ConservePath, "0")
+
+	// and the watch is still there for the save after
+	writeTestConfig(t, path, cfg, 80)
+	waitForNode(t, cfg.ConservePath, "1")
+}
+
+func TestRunWithoutConfigFile(t *testing.T) {
+	cfg := testConfig(t)
+	path := filepath.Join(t.TempDir(), "config.toml")
+
+	// like the default config failing to save, Run goes on with cfg
+	d := New(cfg, NewFakeBattery(85, true))
+	d.ConfigPath = path
+	runTestDaemon(t, d)
+	waitForNode(t, cfg.ConservePath, "1")
+
+	// and starts watching once the file shows up
+	writeTestConfig(t, path, cfg, 90)
+	waitForNode(t, cfg.ConservePath, "0")
+}
+
+func TestReloadOutOfMonitorOnly(t *testing.T) {
+	cfg := testConfig(t)
+	path := filepath.Join(t.TempDir(), "config.toml")
+	data := fmt.Sprintf("monitor_only = true\nconserve_path = %q\nevents = false\nreload_debounce = \"10ms\"\n", cfg.ConservePath)
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadConfig(path, func(err error) error { return err })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := New(*loaded, NewFakeBattery(85, true))
+	d.ConfigPath = path
+	runTestDaemon(t, d)
+	time.Sleep(50 * time.Millisecond)
+	if got := readNode(t, cfg.ConservePath); got != "0" {
+		t.Fatalf("conservation_mode = %q with monitor_only, want it untouched", got)
+	}
+
+	// the control wasn't looked up while monitoring, the reload has to
+	writeTestConfig(t, path, cfg, 80)
+	waitForNode(t, cfg.ConservePath, "1")
+}
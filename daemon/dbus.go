@@ -0,0 +1,130 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+	"github.com/godbus/dbus/v5/prop"
+	"strings"
+)
+
+const (
+	dbusName  = "org.batheart.Daemon"
+	dbusIface = "org.batheart.Daemon"
+	dbusPath  = dbus.ObjectPath("/org/batheart/Daemon")
+)
+
+// dbusService mirrors the control socket on the session bus. Methods go
+// through the same requests channel, so the daemon loop stays the only one
+// touching its state.
+type dbusService struct {
+	conn     *dbus.Conn
+	props    *prop.Properties
+	requests chan<- controlRequest
+	// last conservation state published, for ConservationChanged
+	conserving *bool
+}
+
+func startDBus(requests chan<- controlRequest) (*dbusService, error) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := conn.RequestName(dbusName, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		_ = conn.Close()
+		return nil, fmt.Errorf("%s is already taken on the session bus", dbusName)
+	}
+
+	s := &dbusService{conn: conn, requests: requests}
+	methods := dbusMethods{s}
+	if err := conn.Export(methods, dbusPath, dbusIface); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	s.props, err = prop.Export(conn, dbusPath, prop.Map{dbusIface: {
+		"Capacity":            {Value: uint32(0), Emit: prop.EmitTrue},
+		"Charging":            {Value: false, Emit: prop.EmitTrue},
+		"ConservationEnabled": {Value: false, Emit: prop.EmitTrue},
+		"Threshold":           {Value: uint32(0), Emit: prop.EmitTrue},
+	}})
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	node := &introspect.Node{
+		Name: string(dbusPath),
+		Interfaces: []introspect.Interface{
+			introspect.IntrospectData,
+			prop.IntrospectData,
+			{
+				Name:       dbusIface,
+				Methods:    introspect.Methods(methods),
+				Properties: s.props.Introspection(dbusIface),
+				Signals: []introspect.Signal{{
+					Name: "ConservationChanged",
+					Args: []introspect.Arg{{Name: "enabled", Type: "b"}},
+				}},
+			},
+		},
+	}
+	if err := conn.Export(introspect.NewIntrospectable(node), dbusPath, "org.freedesktop.DBus.Introspectable"); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// update publishes the loop state, called after every evaluation.
+func (s *dbusService) update(st *daemonState, threshold uint) {
+	s.props.SetMust(dbusIface, "Capacity", uint32(st.prevLevel))
+	s.props.SetMust(dbusIface, "Charging", st.charging)
+	s.props.SetMust(dbusIface, "ConservationEnabled", st.conserving)
+	s.props.SetMust(dbusIface, "Threshold", uint32(threshold))
+
+	if st.applied && (s.conserving == nil || *s.conserving != st.conserving) {
+		conserving := st.conserving
+		s.conserving = &conserving
+		_ = s.conn.Emit(dbusPath, dbusIface+".ConservationChanged", conserving)
+	}
+}
+
+func (s *dbusService) Close() error {
+	return s.conn.Close()
+}
+
+func (s *dbusService) send(cmd string) *dbus.Error {
+	req := controlRequest{cmd: cmd, reply: make(chan string, 1)}
+	s.requests <- req
+	if reply := <-req.reply; strings.HasPrefix(reply, "error: ") {
+		return dbus.MakeFailedError(errors.New(strings.TrimPrefix(reply, "error: ")))
+	}
+	return nil
+}
+
+// dbusMethods keeps the exported method set down to what's on the bus.
+type dbusMethods struct {
+	s *dbusService
+}
+
+// SetThreshold overrides the stop threshold until the daemon restarts, 0
+// goes back to the configured one.
+func (m dbusMethods) SetThreshold(threshold uint32) *dbus.Error {
+	return m.s.send(fmt.Sprintf("threshold %d", threshold))
+}
+
+func (m dbusMethods) Toggle() *dbus.Error {
+	return m.s.send("toggle")
+}
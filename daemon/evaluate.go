@@ -0,0 +1,393 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// daemonState is what the loop remembers between evaluations.
+type daemonState struct {
+	prevLevel uint
+	// the level read last time, valid once sampled is set
+	lastRead uint
+	sampled  bool
+	ready    bool
+	// skip the unchanged-level short-circuit once, after reloads and uevents
+	force    bool
+	charging bool
+	// why the last evaluation couldn't read the battery or write
+	// conservation mode, nil when it could
+	err error
+	// any Mains adapter online and the one picked, see PluggedIn
+	plugged bool
+	adapter string
+	// last successfully applied conservation mode, valid once applied is set
+	conserving bool
+	applied    bool
+	// when conserving last changed, for min_toggle_interval
+	lastToggle time.Time
+	// set from the control socket, wins over the threshold until "auto"
+	manual *bool
+	// charge-full from the control socket, until 100% or unplugged
+	chargeFull bool
+	// notify_low already fired for this discharge
+	lowNotified bool
+	// consecutive failed battery reads, drives readBackoff
+	readFailures int
+	// the battery was pulled, polling at idle_interval until it's back
+	absent     bool
+	hot        bool
+	converging bool
+	// name of the active time-of-day profile, "" for the global threshold
+	profile string
+	// set from the control socket or D-Bus, wins over config and profiles
+	threshold uint
+	// storage mode from the control socket, nil follows the storage option
+	storage *bool
+	// when the daemon started, zero with --once, for startup_grace
+	started   time.Time
+	graceOver bool
+	// the last smoothing_window levels and their rounded average
+	readings     []uint
+	prevSmoothed uint
+}
+
+// checkTemperature tells whether the battery is above max_temp, warning
+// once when it gets there and forcing an evaluation whenever that changes.
+// Drivers without a temp file never count as hot.
+func (st *daemonState) checkTemperature(cfg *Config, b *Battery) bool {
+	if cfg.MaxTemp == 0 {
+		return false
+	}
+	temp, err := b.Temperature()
+	if err != nil {
+		return false
+	}
+
+	hot := temp > cfg.MaxTemp
+	if hot && !st.hot {
+		slog.Warn("Battery is too hot", "temp", temp, "max_temp", cfg.MaxTemp, "force_conservation", cfg.MaxTempConserve)
+		st.force = true
+	} else if !hot && st.hot {
+		slog.Info("Battery cooled down", "temp", temp)
+		st.force = true
+	}
+	st.hot = hot
+	return hot
+}
+
+// readFailed backs off after consecutive failed battery reads, e.g. while
+// the driver is gone over suspend, logging once per backoff step.
+func (st *daemonState) readFailed(err error) time.Duration {
+	prev := readBackoff(st.readFailures)
+	st.readFailures++
+	next := readBackoff(st.readFailures)
+	if next != prev || st.readFailures == 1 {
+		slog.Error("Error reading battery level", "err", err, "failures", st.readFailures, "retry_in", next)
+	}
+	return next
+}
+
+// startupGrace is how much of startup_grace is left, forcing an evaluation
+// once it runs out.
+func (st *daemonState) startupGrace(cfg *Config) time.Duration {
+	if st.started.IsZero() || st.graceOver || cfg.StartupGrace == 0 {
+		return 0
+	}
+	if left := cfg.StartupGrace - time.Since(st.started); left > 0 {
+		return left
+	}
+	slog.Info("Startup grace period is over, conservation applies again", "grace", cfg.StartupGrace)
+	st.graceOver, st.force = true, true
+	return 0
+}
+
+// smooth averages level with the readings before it, over the last window
+// of them. A window of 0 or 1 leaves the level as is.
+func (st *daemonState) smooth(level uint, window uint) uint {
+	if window <= 1 {
+		st.readings = nil
+		return level
+	}
+	st.readings = append(st.readings, level)
+	if over := len(st.readings) - int(window); over > 0 {
+		st.readings = st.readings[over:]
+	}
+	var sum uint
+	for _, r := range st.readings {
+		sum += r
+	}
+	n := uint(len(st.readings))
+	return (sum + n/2) / n
+}
+
+// storageOn tells whether storage mode applies, the control socket's word
+// over the config's.
+func (st *daemonState) storageOn(cfg *Config) bool {
+	if st.storage != nil {
+		return *st.storage
+	}
+	return cfg.Storage
+}
+
+// withThreshold applies a threshold set at runtime on a copy of cfg.
+func (st *daemonState) withThreshold(cfg *Config) *Config {
+	if st.threshold == 0 {
+		return cfg
+	}
+	c := *cfg
+	c.Threshold, c.StopThreshold = st.threshold, 0
+	return &c
+}
+
+func readBackoff(failures int) time.Duration {
+	if failures == 0 {
+		return 0
+	}
+	backoff := time.Minute
+	for i := 1; i < failures && backoff < maxReadBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxReadBackoff)
+}
+
+// evaluate reads the battery level and applies conservation mode, returning
+// the interval until the next evaluation or 0 to keep the current one.
+func (d *Daemon) evaluate(cfg *Config, st *daemonState) time.Duration {
+	st.err = nil
+	if !d.present() {
+		st.err = errors.New("battery isn't present")
+		if !st.absent {
+			slog.Warn("Battery isn't present, waiting for it to come back", "retry_in", cfg.IdleInterval)
+			st.absent = true
+		}
+		return cfg.IdleInterval
+	}
+	if st.absent {
+		slog.Info("Battery is back", "path", d.battery.Path())
+		st.absent = false
+		st.readings = nil
+		st.force = true
+	}
+
+	level, err := d.src.Capacity()
+	if err != nil {
+		st.err = err
+		return st.readFailed(err)
+	}
+	if st.readFailures > 0 {
+		slog.Info("Battery readable again", "failures", st.readFailures)
+		st.readFailures = 0
+		st.force = true // get the ticker off the backoff interval
+	}
+	if s, ok := d.src.(interface{ switched() bool }); ok && s.switched() {
+		st.readings = nil // a different backend, start averaging over
+	}
+	d.stats.capacity.Store(int64(level))
+	smoothed := st.smooth(level, cfg.SmoothingWindow)
+	d.stats.lastRead.Store(int64(time.Since(processStart)))
+	// read here rather than on scrape, sysfs belongs to the loop
+	if health, err := d.battery.Health(); err == nil {
+		d.stats.health.Store(&health)
+	}
+	if !st.ready {
+		sdNotify("READY=1")
+		st.ready = true
+	}
+	cfg, profileName := cfg.withProfile(time.Now())
+	storage := st.storageOn(cfg)
+	if storage {
+		profileName = "storage"
+	}
+	if profileName != st.profile {
+		slog.Info("Switched charging profile", "profile", profileName, "threshold", cfg.StopAt())
+		st.profile = profileName
+		st.force = true
+	}
+	adapter, plugged := PluggedIn()
+	if adapter != st.adapter {
+		slog.Debug("AC adapter changed", "plugged", plugged, "adapter", adapter)
+		st.adapter = adapter
+		st.force = true
+	}
+	cfg = st.withThreshold(cfg.withAdapter(adapter))
+	if storage {
+		cfg = cfg.withStorage()
+	}
+
+	charging, err := d.src.Charging()
+	if err != nil {
+		slog.Warn("Error reading charging state", "err", err)
+	}
+	// a rising level is as good a hint as the reported status, once there's
+	// a reading to compare with
+	charging = charging || (st.sampled && level > st.lastRead)
+	st.lastRead, st.sampled = level, true
+	d.stats.charging.Store(charging)
+	st.notifyLow(level, charging, cfg)
+
+	grace := st.startupGrace(cfg)
+	// before the short-circuit, the temperature changes at the same level
+	hot := st.checkTemperature(cfg, d.battery)
+
+	// plugging in at exactly the threshold changes nothing but charging
+	if level == st.prevLevel && smoothed == st.prevSmoothed && charging == st.charging && plugged == st.plugged && !st.force {
+		return 0
+	}
+	st.force = false
+	st.charging, st.plugged, st.prevSmoothed = charging, plugged, smoothed
+
+	d.stats.threshold.Store(int64(cfg.StopAt()))
+	enable, target, next := decideConservation(smoothed, charging, plugged, cfg)
+	if charging && !enable {
+		if eta, rate, err := d.battery.timeToLevel(cfg.StopAt()); err == nil {
+			// look again halfway there, a fast charger blows past the
+			// threshold within a poll interval
+			if half := eta / 2; half < next {
+				next = max(half, cfg.ConvergeInterval)
+			}
+			slog.Debug("Charge rate", "rate", rate, "to_threshold", eta.Round(time.Second), "next", next)
+		}
+	}
+	if d.armedByFirmware() && target < 100 {
+		// the firmware stops at the target by itself, just keep it armed
+		enable = true
+	}
+	if grace > 0 {
+		// top up first, look again right when the grace period ends
+		enable, next = false, min(next, grace)
+	}
+	if st.chargeFull {
+		if level >= 100 || (!plugged && !charging) {
+			slog.Info("Charge to full is over, back to normal", "level", level, "plugged", plugged)
+			if cfg.Notify {
+				notify(fmt.Sprintf("Charge to full is over at %d%%", level))
+			}
+			st.chargeFull = false
+		} else {
+			enable = false
+		}
+	}
+	if hot && cfg.MaxTempConserve {
+		enable = true
+	}
+	if st.manual != nil {
+		enable = *st.manual
+	}
+	// asking for it by hand doesn't wait for min_toggle_interval
+	if wait := cfg.MinToggleInterval - time.Since(st.lastToggle); st.manual == nil && st.applied && enable != st.conserving && wait > 0 {
+		slog.Info("Deferring conservation change, it changed too recently", "enabled", enable, "level", level, "wait", wait.Round(time.Second))
+		st.force = true // look again once it's allowed, even at the same level
+		// but keep polling meanwhile, for the metrics and anything changing
+		return min(wait, next)
+	}
+
+	if d.monitoring(cfg) {
+		slog.Debug("Monitoring only, leaving conservation alone", "level", level, "charging", charging, "would_enable", enable)
+		st.prevLevel = level
+		return next
+	}
+
+	if err := d.setConservationMode(enable, target, cfg); err != nil {
+		st.err = err
+		d.stats.writeErrors.Add(1)
+		// keep prevLevel so the write is retried, but don't hammer sysfs
+		slog.Error("Conservation mode write failed", "err", err, "retry_in", conserveRetryInterval)
+		return conserveRetryInterval
+	}
+	slog.Debug("Evaluated battery", "level", level, "charging", charging, "conservation", enable, "next", next)
+
+	// converging polls fast until the firmware confirms it stopped charging
+	switch {
+	case next == cfg.ConvergeInterval:
+		st.converging = true
+	case st.converging:
+		st.converging = false
+		if enable && !charging {
+			slog.Info("Conservation converged, charging stopped", "level", level, "next", next)
+		}
+	}
+
+	if !st.applied || st.conserving != enable {
+		st.lastToggle = time.Now()
+		slog.Info("Changed conservation mode", "enabled", enable, "level", level, "target", target)
+		if cfg.Notify {
+			notifyConservation(level, enable)
+		}
+		if enable {
+			runHook(cfg.OnEnableCmd, level, charging)
+		} else {
+			runHook(cfg.OnDisableCmd, level, charging)
+		}
+	}
+	st.conserving, st.applied = enable, true
+	d.stats.conserving.Store(enable)
+
+	st.prevLevel = level
+	return next
+}
+
+// present asks the source whether the battery is there when it can tell,
+// and sysfs otherwise.
+func (d *Daemon) present() bool {
+	if p, ok := d.src.(interface{ Present() bool }); ok {
+		return p.Present()
+	}
+	return d.battery.Present()
+}
+
+// decideConservation holds the whole threshold logic without touching the
+// hardware: whether conservation should be on, the percentage to stop at
+// for hardware that takes one, and when to look again.
+func decideConservation(capacity uint, charging, plugged bool, cfg *Config) (enable bool, target uint, nextInterval time.Duration) {
+	threshold := cfg.StopAt()
+	target = threshold
+	if cfg.TargetPercent != 0 {
+		target = cfg.TargetPercent
+	}
+
+	if capacity < cfg.LowFloor {
+		slog.Info("Below low_floor, charging fully", "capacity", capacity, "low_floor", cfg.LowFloor)
+		return false, 100, cfg.PollInterval
+	}
+	// band is the levels the comparison enables conservation at, for the log
+	var band string
+	switch cfg.Comparison {
+	case "band":
+		// can flap off again when the level jumps past the band between ticks
+		lo, hi := satSub(threshold, cfg.Tolerance), threshold+cfg.Tolerance
+		enable, band = capacity >= lo && capacity <= hi, fmt.Sprintf("%d..%d", lo, hi)
+	case "exact":
+		// only for perfectly stepped levels, anything else misses it
+		enable, band = capacity == threshold, fmt.Sprintf("%d..%d", threshold, threshold)
+	default:
+		// anything at or past the threshold counts, a slow tick can jump over it
+		enable, band = capacity >= threshold, fmt.Sprintf("%d..100", threshold)
+	}
+	// sitting on AC at full often reads discharging or not charging, keep it
+	// held there rather than let a narrow comparison drop it
+	if plugged && capacity >= threshold {
+		enable = true
+	}
+
+	var reason string
+	switch {
+	case capacity >= satSub(threshold, cfg.Tolerance) && charging:
+		nextInterval, reason = cfg.ConvergeInterval, "charging in band, converge"
+	case !enable && capacity < satSub(threshold, 5): // Add hysteresis
+		nextInterval, reason = cfg.IdleInterval, "well below threshold, idle"
+	default:
+		nextInterval, reason = cfg.PollInterval, "poll"
+	}
+	slog.Debug("Decided conservation",
+		"capacity", capacity, "charging", charging, "plugged", plugged, "threshold", threshold,
+		"comparison", cfg.Comparison, "band", band,
+		"reason", reason, "enable", enable, "next", nextInterval)
+	return enable, target, nextInterval
+}
@@ -0,0 +1,233 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package daemon
+
+import (
+	"bytes"
+	"gioui.org/x/pref/battery"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecideConservation(t *testing.T) {
+	cfg := defaultConfig()
+	for _, tc := range []struct {
+		name     string
+		capacity uint
+		charging bool
+		enable   bool
+		next     time.Duration
+	}{
+		{"well below, discharging", 70, false, false, cfg.IdleInterval},
+		{"well below, charging", 70, true, false, cfg.IdleInterval},
+		{"below the band, charging", 78, true, false, cfg.PollInterval},
+		{"just below, discharging", 79, false, false, cfg.PollInterval},
+		{"just below, charging", 79, true, false, cfg.ConvergeInterval},
+		{"at threshold, charging", 80, true, true, cfg.ConvergeInterval},
+		{"at threshold, discharging", 80, false, true, cfg.PollInterval},
+		{"above threshold, discharging", 90, false, true, cfg.PollInterval},
+		{"full", 100, false, true, cfg.PollInterval},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			enable, target, next := decideConservation(tc.capacity, tc.charging, false, cfg)
+			if enable != tc.enable || next != tc.next {
+				t.Errorf("decideConservation(%d, %t) = %t, %s, want %t, %s", tc.capacity, tc.charging, enable, next, tc.enable, tc.next)
+			}
+			if target != 80 {
+				t.Errorf("target = %d, want the threshold", target)
+			}
+		})
+	}
+}
+
+func TestEvaluateSkipsUnchangedLevel(t *testing.T) {
+	cfg := testConfig(t)
+	d := newTestDaemon(t, cfg, NewFakeBattery(85, false))
+	st := daemonState{}
+
+	d.evaluate(d.cfg, &st)
+	if got := readNode(t, cfg.ConservePath); got != "1" {
+		t.Fatalf("conservation_mode = %q at 85%%, want 1", got)
+	}
+
+	// nothing changed, so the node isn't written again
+	writeNode(t, "bus/platform/drivers/ideapad_acpi/VPC2004:00/conservation_mode", "0")
+	if next := d.evaluate(d.cfg, &st); next != 0 {
+		t.Errorf("unchanged level returned %s, want 0 to keep the interval", next)
+	}
+	if got := readNode(t, cfg.ConservePath); got != "0" {
+		t.Errorf("conservation_mode = %q, want it left alone at the same level", got)
+	}
+
+	st.force = true
+	d.evaluate(d.cfg, &st)
+	if got := readNode(t, cfg.ConservePath); got != "1" {
+		t.Errorf("conservation_mode = %q after a forced evaluation, want 1", got)
+	}
+}
+
+func TestEvaluateRisingLevelCountsAsCharging(t *testing.T) {
+	cfg := testConfig(t)
+	fake := NewFakeBattery(60, false)
+	d := newTestDaemon(t, cfg, fake)
+	st := daemonState{}
+
+	d.evaluate(d.cfg, &st)
+	if st.charging {
+		t.Error("first evaluation counted as charging without a reading to compare with")
+	}
+	fake.Set(62, false)
+	d.evaluate(d.cfg, &st)
+	if !st.charging {
+		t.Error("level rising from 60 to 62 didn't count as charging")
+	}
+}
+
+func TestEvaluateHotAtSameLevel(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MaxTemp, cfg.MaxTempConserve = 45, true
+	writeNode(t, "class/power_supply/BAT0/type", "Battery")
+	temp := writeNode(t, "class/power_supply/BAT0/temp", "300")
+	d := newTestDaemon(t, cfg, NewFakeBattery(70, false))
+	st := daemonState{}
+
+	d.evaluate(d.cfg, &st)
+	if got := readNode(t, cfg.ConservePath); got != "0" {
+		t.Fatalf("conservation_mode = %q at 70%% and 30°C, want 0", got)
+	}
+
+	// only the temperature changes, the level stays at 70
+	if err := os.WriteFile(temp, []byte("500"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	d.evaluate(d.cfg, &st)
+	if got := readNode(t, cfg.ConservePath); got != "1" {
+		t.Errorf("conservation_mode = %q at 50°C over max_temp 45, want 1", got)
+	}
+
+	if err := os.WriteFile(temp, []byte("300"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	d.evaluate(d.cfg, &st)
+	if got := readNode(t, cfg.ConservePath); got != "0" {
+		t.Errorf("conservation_mode = %q once cooled down, want 0", got)
+	}
+}
+
+func TestEvaluateReappliesOnChargingChange(t *testing.T) {
+	cfg := testConfig(t)
+	fake := NewFakeBattery(80, false)
+	d := newTestDaemon(t, cfg, fake)
+	st := daemonState{}
+	d.evaluate(d.cfg, &st)
+
+	// e.g. plugged in at exactly the threshold, the level doesn't move
+	writeNode(t, "bus/platform/drivers/ideapad_acpi/VPC2004:00/conservation_mode", "0")
+	fake.Set(80, true)
+	if next := d.evaluate(d.cfg, &st); next == 0 {
+		t.Error("same level with charging changed was short-circuited")
+	}
+	if got := readNode(t, cfg.ConservePath); got != "1" {
+		t.Errorf("conservation_mode = %q, want it applied again", got)
+	}
+}
+
+func TestEvaluateConvergesBackToPollInterval(t *testing.T) {
+	cfg := testConfig(t)
+	fake := NewFakeBattery(75, true)
+	d := newTestDaemon(t, cfg, fake)
+	st := daemonState{}
+
+	for _, step := range []struct {
+		level    uint
+		charging bool
+		next     time.Duration
+	}{
+		{75, true, cfg.PollInterval},
+		{79, true, cfg.ConvergeInterval},
+		{80, true, cfg.ConvergeInterval},
+		// the firmware stopped charging at the threshold
+		{80, false, cfg.PollInterval},
+	} {
+		fake.Set(step.level, step.charging)
+		if next := d.evaluate(d.cfg, &st); next != step.next {
+			t.Errorf("at %d%% charging %t: next %s, want %s", step.level, step.charging, next, step.next)
+		}
+	}
+	if st.converging {
+		t.Error("still converging after charging stopped")
+	}
+	if got := readNode(t, cfg.ConservePath); got != "1" {
+		t.Errorf("conservation_mode = %q at the threshold, want 1", got)
+	}
+}
+
+func TestDecideConservationLogsBand(t *testing.T) {
+	prev := slog.Default()
+	defer slog.SetDefault(prev)
+
+	for comparison, want := range map[string]string{"gte": "80..100", "band": "78..82", "exact": "80..80"} {
+		var buf bytes.Buffer
+		slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+		cfg := defaultConfig()
+		cfg.Comparison, cfg.Tolerance = comparison, 2
+		decideConservation(79, false, false, cfg)
+		if !strings.Contains(buf.String(), "band="+want+" ") {
+			t.Errorf("comparison %s logged %q, want band=%s", comparison, buf.String(), want)
+		}
+	}
+}
+
+func TestManualSkipsMinToggleInterval(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MinToggleInterval = time.Hour
+	fake := NewFakeBattery(85, false)
+	d := newTestDaemon(t, cfg, fake)
+	st := daemonState{}
+	d.evaluate(d.cfg, &st)
+
+	// the threshold changing its mind right away waits
+	fake.Set(60, false)
+	if next := d.evaluate(d.cfg, &st); next != cfg.IdleInterval {
+		t.Errorf("deferred change returned %s, want idle_interval %s rather than the rest of the hour", next, cfg.IdleInterval)
+	}
+	if got := readNode(t, cfg.ConservePath); got != "1" {
+		t.Errorf("conservation_mode = %q within min_toggle_interval, want 1 kept", got)
+	}
+
+	// the user asking for it doesn't
+	fake.Set(85, false)
+	if _, err := st.control("disable"); err != nil {
+		t.Fatal(err)
+	}
+	d.evaluate(d.cfg, &st)
+	if got := readNode(t, cfg.ConservePath); got != "0" {
+		t.Errorf("conservation_mode = %q after disable, want 0 right away", got)
+	}
+}
+
+func TestBackendSwitchResetsSmoothing(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.SmoothingWindow = 3
+	writeNode(t, "class/power_supply/BAT0/type", "Battery")
+	writeNode(t, "class/power_supply/BAT0/capacity", "60")
+	d := newTestDaemon(t, cfg, NewBattery(""))
+	st := daemonState{readings: []uint{90, 90}}
+
+	// what gio does on a platform it doesn't support
+	g := &gioBattery{sysfs: d.battery}
+	if !g.unavailable(battery.ErrNotAvailableAPI) {
+		t.Fatal("ErrNotAvailableAPI didn't switch to sysfs")
+	}
+	d.src = g
+
+	d.evaluate(d.cfg, &st)
+	if st.prevSmoothed != 60 || len(st.readings) != 1 {
+		t.Errorf("after the switch: smoothed %d over %v, want 60 from the sysfs reading alone", st.prevSmoothed, st.readings)
+	}
+}
@@ -0,0 +1,60 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package daemon
+
+import "sync"
+
+// FakeBattery is a BatterySource reporting whatever it was last set to,
+// for driving the daemon in tests without a battery.
+type FakeBattery struct {
+	mu       sync.Mutex
+	level    uint
+	charging bool
+	absent   bool
+	err      error
+}
+
+func NewFakeBattery(level uint, charging bool) *FakeBattery {
+	return &FakeBattery{level: level, charging: charging}
+}
+
+// Set changes what the next reads return.
+func (f *FakeBattery) Set(level uint, charging bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.level, f.charging = level, charging
+}
+
+// Fail makes every read return err until it's called with nil.
+func (f *FakeBattery) Fail(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+// Pull takes the battery out, and puts it back once absent is false.
+func (f *FakeBattery) Pull(absent bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.absent = absent
+}
+
+func (f *FakeBattery) Capacity() (uint, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.level, f.err
+}
+
+func (f *FakeBattery) Charging() (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.charging, f.err
+}
+
+func (f *FakeBattery) Present() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return !f.absent
+}
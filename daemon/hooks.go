@@ -0,0 +1,40 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package daemon
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+const hookTimeout = time.Second * 30
+
+// runHook runs a user command through sh in the background, killing it if
+// it outlives hookTimeout so a stuck script can't pile up.
+func runHook(command string, level uint, charging bool) {
+	if command == "" {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+		defer cancel()
+
+		c := exec.CommandContext(ctx, "sh", "-c", command)
+		c.Env = append(os.Environ(),
+			"BATHEART_CAPACITY="+strconv.Itoa(int(level)),
+			"BATHEART_CHARGING="+strconv.FormatBool(charging),
+		)
+		if out, err := c.CombinedOutput(); err != nil {
+			slog.Warn("Hook failed", "cmd", command, "err", err, "output", string(out))
+			return
+		}
+		slog.Debug("Hook finished", "cmd", command)
+	}()
+}
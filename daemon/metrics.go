@@ -0,0 +1,112 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// metrics is scraped in the Prometheus text format, there's few enough of
+// them that a client library isn't worth it.
+type metrics struct {
+	capacity    atomic.Int64
+	charging    atomic.Bool
+	conserving  atomic.Bool
+	writeErrors atomic.Uint64
+	// the stop threshold the last evaluation went by
+	threshold     atomic.Int64
+	configReloads atomic.Uint64
+	configErrors  atomic.Uint64
+	// monotonic nanos since processStart of the last successful battery
+	// read, for /healthz, so a wall clock step doesn't make it look stale
+	lastRead atomic.Int64
+	// battery health as of the last evaluation, nil when the driver has none
+	health atomic.Pointer[float64]
+}
+
+var processStart = time.Now()
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetric(w, "batheart_battery_capacity", "gauge", "Battery capacity in percent.", m.capacity.Load())
+	writeMetric(w, "batheart_charging", "gauge", "Whether the battery is charging.", boolMetric(m.charging.Load()))
+	writeMetric(w, "batheart_conservation_enabled", "gauge", "Whether conservation mode is enabled.", boolMetric(m.conserving.Load()))
+	writeMetric(w, "batheart_sysfs_write_errors_total", "counter", "Failed conservation mode writes.", m.writeErrors.Load())
+	writeMetric(w, "batheart_threshold", "gauge", "Active stop threshold in percent.", m.threshold.Load())
+	writeMetric(w, "batheart_config_reloads_total", "counter", "Successful config reloads.", m.configReloads.Load())
+	writeMetric(w, "batheart_config_errors_total", "counter", "Failed config reloads.", m.configErrors.Load())
+	if health := m.health.Load(); health != nil {
+		writeMetric(w, "batheart_battery_health_percent", "gauge", "Full capacity relative to design capacity.", *health)
+	}
+}
+
+func writeMetric(w http.ResponseWriter, name, kind, help string, value any) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+}
+
+func boolMetric(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// healthHandler answers 200 while the battery was read successfully within
+// maxAge and 503 otherwise.
+func (m *metrics) healthHandler(maxAge func() time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		last := m.lastRead.Load()
+		if last == 0 {
+			http.Error(w, "no successful battery read yet", http.StatusServiceUnavailable)
+			return
+		}
+		if age := time.Since(processStart) - time.Duration(last); age > maxAge() {
+			http.Error(w, fmt.Sprintf("last successful battery read %s ago", age.Round(time.Second)), http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = fmt.Fprintln(w, "ok")
+	})
+}
+
+// startServers serves each path on its address, paths sharing an address
+// share a server.
+func startServers(routes map[string]map[string]http.Handler) []*http.Server {
+	var servers []*http.Server
+	for addr, handlers := range routes {
+		mux := http.NewServeMux()
+		var paths []string
+		for path, h := range handlers {
+			mux.Handle(path, h)
+			paths = append(paths, path)
+		}
+
+		slices.Sort(paths)
+
+		srv := &http.Server{Addr: addr, Handler: mux}
+		go func() {
+			if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("HTTP server failed", "addr", addr, "err", err)
+			}
+		}()
+		slog.Info("Serving HTTP", "addr", addr, "paths", paths)
+		servers = append(servers, srv)
+	}
+	return servers
+}
+
+func stopServers(servers []*http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	for _, srv := range servers {
+		_ = srv.Shutdown(ctx)
+	}
+}
@@ -0,0 +1,35 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package daemon
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsHealthFromLastEvaluation(t *testing.T) {
+	cfg := testConfig(t)
+	writeNode(t, "class/power_supply/BAT0/type", "Battery")
+	writeNode(t, "class/power_supply/BAT0/energy_full", "45000000")
+	writeNode(t, "class/power_supply/BAT0/energy_full_design", "50000000")
+	d := newTestDaemon(t, cfg, NewFakeBattery(70, false))
+
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		d.stats.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		return rec.Body.String()
+	}
+	if body := scrape(); strings.Contains(body, "batheart_battery_health_percent") {
+		t.Errorf("health reported before any evaluation:\n%s", body)
+	}
+
+	d.evaluate(d.cfg, &daemonState{})
+	// sysfs changing afterwards doesn't show until the next evaluation
+	writeNode(t, "class/power_supply/BAT0/energy_full", "40000000")
+	if body := scrape(); !strings.Contains(body, "batheart_battery_health_percent 90\n") {
+		t.Errorf("want health 90 from the evaluation:\n%s", body)
+	}
+}
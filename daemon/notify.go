@@ -0,0 +1,41 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package daemon
+
+import (
+	"fmt"
+	"log/slog"
+	"os/exec"
+)
+
+// notify pops a desktop notification through notify-send. Without it, or
+// without a notification daemon to talk to, it quietly does nothing.
+func notify(summary string) {
+	path, err := exec.LookPath("notify-send")
+	if err != nil {
+		return
+	}
+	go func() { _ = exec.Command(path, "--app-name=batheart", summary).Run() }()
+}
+
+func notifyConservation(level uint, enabled bool) {
+	state := "disabled"
+	if enabled {
+		state = "enabled"
+	}
+	notify(fmt.Sprintf("Battery at %d%%, conservation %s", level, state))
+}
+
+// notifyLow warns once per drop below notify_low, charging again resets it.
+func (st *daemonState) notifyLow(level uint, charging bool, cfg *Config) {
+	switch {
+	case charging:
+		st.lowNotified = false
+	case cfg.NotifyLow != 0 && level < cfg.NotifyLow && !st.lowNotified:
+		slog.Info("Battery is low", "level", level, "notify_low", cfg.NotifyLow)
+		notify(fmt.Sprintf("Battery low, %d%% left", level))
+		st.lowNotified = true
+	}
+}
@@ -0,0 +1,71 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package daemon
+
+import (
+	"fmt"
+	"time"
+)
+
+// Profile overrides the threshold for a daily time window, windows may
+// wrap around midnight like 22:00 to 06:00.
+type Profile struct {
+	Name      string `koanf:"name"`
+	Start     string `koanf:"start"`
+	End       string `koanf:"end"`
+	Threshold uint   `koanf:"threshold"`
+}
+
+const profileTimeLayout = "15:04"
+
+func (p Profile) validate(startThreshold uint) error {
+	if _, err := time.Parse(profileTimeLayout, p.Start); err != nil {
+		return fmt.Errorf("profile %q: start %q isn't HH:MM", p.Name, p.Start)
+	}
+	if _, err := time.Parse(profileTimeLayout, p.End); err != nil {
+		return fmt.Errorf("profile %q: end %q isn't HH:MM", p.Name, p.End)
+	}
+	if p.Threshold < 1 || p.Threshold > 100 {
+		return fmt.Errorf("profile %q: threshold %d is outside 1..100", p.Name, p.Threshold)
+	}
+	if p.Threshold <= startThreshold {
+		return fmt.Errorf("profile %q: threshold %d must be above start_threshold %d", p.Name, p.Threshold, startThreshold)
+	}
+	return nil
+}
+
+func (p Profile) contains(now time.Time) bool {
+	start, _ := time.Parse(profileTimeLayout, p.Start)
+	end, _ := time.Parse(profileTimeLayout, p.End)
+	minute := now.Hour()*60 + now.Minute()
+	from, to := start.Hour()*60+start.Minute(), end.Hour()*60+end.Minute()
+
+	if from <= to {
+		return minute >= from && minute < to
+	}
+	return minute >= from || minute < to
+}
+
+// activeProfile is the first profile whose window contains now.
+func (c *Config) activeProfile(now time.Time) (Profile, bool) {
+	for _, p := range c.Profiles {
+		if p.contains(now) {
+			return p, true
+		}
+	}
+	return Profile{}, false
+}
+
+// withProfile is the config as it applies at now, with the stop threshold
+// taken from the active profile if there is one.
+func (c *Config) withProfile(now time.Time) (*Config, string) {
+	p, ok := c.activeProfile(now)
+	if !ok {
+		return c, ""
+	}
+	effective := *c
+	effective.StopThreshold = p.Threshold
+	return &effective, p.Name
+}
@@ -0,0 +1,54 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package daemon
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+)
+
+// watchPowerSupply listens for kernel uevents and signals on the returned
+// channel whenever a power_supply device (battery or adapter) changes.
+func watchPowerSupply() (<-chan struct{}, func(), error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW, syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, nil, os.NewSyscallError("socket", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: 1, // kernel broadcasts
+		Pid:    0,
+	}); err != nil {
+		_ = syscall.Close(fd)
+		return nil, nil, os.NewSyscallError("bind", err)
+	}
+	// nonblocking so reads go through the poller and Close unblocks them
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		_ = syscall.Close(fd)
+		return nil, nil, os.NewSyscallError("setnonblock", err)
+	}
+	sock := os.NewFile(uintptr(fd), "uevent")
+
+	events := make(chan struct{}, 1)
+	go func() {
+		buf := make([]byte, 8192)
+		for {
+			n, err := sock.Read(buf)
+			if err != nil {
+				return // closed by stop
+			}
+			if !bytes.Contains(buf[:n], []byte("\x00SUBSYSTEM=power_supply\x00")) {
+				continue
+			}
+			select {
+			case events <- struct{}{}:
+			default: // one pending evaluation covers a burst of events
+			}
+		}
+	}()
+
+	return events, func() { _ = sock.Close() }, nil
+}
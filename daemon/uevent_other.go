@@ -0,0 +1,13 @@
+//go:build !linux
+
+/*
+Copyright © 2024 offeex
+*/
+
+package daemon
+
+import "errors"
+
+func watchPowerSupply() (<-chan struct{}, func(), error) {
+	return nil, nil, errors.New("power supply events are only supported on linux")
+}
@@ -0,0 +1,91 @@
+/*
+Copyright © 2024 offeex
+*/
+
+package daemon
+
+import (
+	"fmt"
+	"github.com/godbus/dbus/v5"
+	"math"
+)
+
+const (
+	upowerService = "org.freedesktop.UPower"
+	upowerPath    = dbus.ObjectPath("/org/freedesktop/UPower")
+	upowerDevice  = "org.freedesktop.UPower.Device"
+	upowerDisplay = dbus.ObjectPath("/org/freedesktop/UPower/devices/DisplayDevice")
+
+	upowerTypeBattery   = 2
+	upowerStateCharging = 1
+)
+
+// upowerBattery reads the battery from UPower over the system bus, and can
+// switch charge thresholds through it where sysfs writes aren't allowed.
+type upowerBattery struct {
+	display dbus.BusObject
+	// the first real battery, thresholds live there and not on the display device
+	battery dbus.BusObject
+}
+
+func newUpowerBattery() (*upowerBattery, error) {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return nil, err
+	}
+
+	u := &upowerBattery{display: conn.Object(upowerService, upowerDisplay)}
+	if _, err := u.display.GetProperty(upowerDevice + ".Percentage"); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("UPower isn't available: %w", err)
+	}
+
+	var devices []dbus.ObjectPath
+	if err := conn.Object(upowerService, upowerPath).Call(upowerService+".EnumerateDevices", 0).Store(&devices); err == nil {
+		for _, path := range devices {
+			obj := conn.Object(upowerService, path)
+			if v, err := obj.GetProperty(upowerDevice + ".Type"); err == nil && v.Value() == uint32(upowerTypeBattery) {
+				u.battery = obj
+				break
+			}
+		}
+	}
+	return u, nil
+}
+
+func (u *upowerBattery) Capacity() (uint, error) {
+	v, err := u.display.GetProperty(upowerDevice + ".Percentage")
+	if err != nil {
+		return 0, err
+	}
+	percentage, ok := v.Value().(float64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected UPower Percentage %v", v)
+	}
+	return uint(math.Round(percentage)), nil
+}
+
+func (u *upowerBattery) Charging() (bool, error) {
+	v, err := u.display.GetProperty(upowerDevice + ".State")
+	if err != nil {
+		return false, err
+	}
+	return v.Value() == uint32(upowerStateCharging), nil
+}
+
+// thresholdSupported needs UPower 1.90 or newer and a battery it knows
+// how to limit.
+func (u *upowerBattery) thresholdSupported() bool {
+	if u.battery == nil {
+		return false
+	}
+	v, err := u.battery.GetProperty(upowerDevice + ".ChargeThresholdSupported")
+	return err == nil && v.Value() == true
+}
+
+func (u *upowerBattery) setChargeThreshold(enable bool) error {
+	if err := u.battery.Call(upowerDevice+".EnableChargeThreshold", 0, enable).Err; err != nil {
+		return fmt.Errorf("can't change UPower charge threshold: %w", err)
+	}
+	return nil
+}